@@ -0,0 +1,69 @@
+package comunication
+
+import "math"
+
+// ArrivalStats keeps the latest gaps between heartbeats of a device, in seconds
+type ArrivalStats struct {
+	Gaps []float64 `json:"gaps"`
+	Next int       `json:"next"`
+}
+
+// Add stores a gap, overwriting the oldest one once size gaps are kept
+func (s *ArrivalStats) Add(gap float64, size int) {
+	if len(s.Gaps) < size {
+		s.Gaps = append(s.Gaps, gap)
+
+		return
+	}
+
+	if len(s.Gaps) > size {
+		s.Gaps = s.Gaps[len(s.Gaps)-size:]
+	}
+
+	s.Next = s.Next % size
+	s.Gaps[s.Next] = gap
+	s.Next++
+}
+
+func (s ArrivalStats) Count() int {
+	return len(s.Gaps)
+}
+
+func (s ArrivalStats) Mean() float64 {
+	if len(s.Gaps) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, gap := range s.Gaps {
+		sum += gap
+	}
+
+	return sum / float64(len(s.Gaps))
+}
+
+// Jitter is the standard deviation of the gaps
+func (s ArrivalStats) Jitter() float64 {
+	if len(s.Gaps) < 2 {
+		return 0
+	}
+
+	mean := s.Mean()
+	var sum float64
+	for _, gap := range s.Gaps {
+		sum += (gap - mean) * (gap - mean)
+	}
+
+	return math.Sqrt(sum / float64(len(s.Gaps)-1))
+}
+
+func (s ArrivalStats) Max() float64 {
+	var max float64
+	for _, gap := range s.Gaps {
+		if gap > max {
+			max = gap
+		}
+	}
+
+	return max
+}
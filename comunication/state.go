@@ -0,0 +1,135 @@
+package comunication
+
+import "time"
+
+type LineState string
+
+const (
+	LineUnknown     LineState = "unknown"
+	LineOn          LineState = "on"
+	LineOff         LineState = "off"
+	LineUnreachable LineState = "unreachable"
+	LineMuted       LineState = "muted"
+)
+
+type LineInput string
+
+const (
+	InputPowerOn  LineInput = "power_on"
+	InputPowerOff LineInput = "power_off"
+	InputLost     LineInput = "lost"
+	InputMute     LineInput = "mute"
+	InputUnmute   LineInput = "unmute"
+)
+
+// Line is the state machine of a monitored line. Observed is what the monitor knows about the
+// line (unknown, on, off or unreachable), State is what is shown: the observed state or muted.
+// While muted the observed state keeps changing, so unmuting returns to the actual state.
+type Line struct {
+	State         LineState `json:"state"`
+	Since         time.Time `json:"since"`
+	Observed      LineState `json:"observed"`
+	ObservedSince time.Time `json:"observedSince"`
+}
+
+// LineEvent is emitted by every change of the line. PreviousSince is when the left state was entered.
+type LineEvent struct {
+	Input         LineInput `json:"input"`
+	From          LineState `json:"from"`
+	To            LineState `json:"to"`
+	At            time.Time `json:"at"`
+	PreviousSince time.Time `json:"previousSince"`
+	Muted         bool      `json:"muted"`
+}
+
+func NewLine() Line {
+	return Line{State: LineUnknown, Observed: LineUnknown}
+}
+
+// IsObserved tells the event changed the observed state, not only the muting
+func (e LineEvent) IsObserved() bool {
+	return e.Input != InputMute && e.Input != InputUnmute
+}
+
+// ShouldNotify is true for observed changes residents must hear about: not the first
+// state of a new line and not while the line is muted.
+func (e LineEvent) ShouldNotify() bool {
+	return e.IsObserved() && !e.Muted && e.From != LineUnknown
+}
+
+func (l Line) IsMuted() bool {
+	return l.State == LineMuted
+}
+
+// Apply feeds an input to the line, the event is returned only when the line changed
+func (l *Line) Apply(input LineInput, at time.Time) (LineEvent, bool) {
+	if l.State == "" {
+		*l = NewLine()
+	}
+
+	switch input {
+	case InputMute:
+		if l.State == LineMuted {
+			return LineEvent{}, false
+		}
+
+		event := LineEvent{Input: input, From: l.State, To: LineMuted, At: at, PreviousSince: l.Since, Muted: true}
+		l.State = LineMuted
+		l.Since = at
+
+		return event, true
+	case InputUnmute:
+		if l.State != LineMuted {
+			return LineEvent{}, false
+		}
+
+		event := LineEvent{Input: input, From: LineMuted, To: l.Observed, At: at, PreviousSince: l.Since}
+		l.State = l.Observed
+		l.Since = at
+
+		return event, true
+	}
+
+	observed := observedState(input)
+
+	if observed == "" || observed == l.Observed {
+		return LineEvent{}, false
+	}
+
+	event := LineEvent{
+		Input:         input,
+		From:          l.Observed,
+		To:            observed,
+		At:            at,
+		PreviousSince: l.ObservedSince,
+		Muted:         l.State == LineMuted,
+	}
+
+	l.Observed = observed
+	l.ObservedSince = at
+
+	if l.State != LineMuted {
+		l.State = observed
+		l.Since = at
+	}
+
+	return event, true
+}
+
+func observedState(input LineInput) LineState {
+	switch input {
+	case InputPowerOn:
+		return LineOn
+	case InputPowerOff:
+		return LineOff
+	case InputLost:
+		return LineUnreachable
+	}
+
+	return ""
+}
+
+// RestoredLine is a line already in the given state, used for devices stored before the state machine
+func RestoredLine(state LineState, since time.Time) Line {
+	return Line{State: state, Since: since, Observed: state, ObservedSince: since}
+}
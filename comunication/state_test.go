@@ -0,0 +1,122 @@
+package comunication
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLineApply(t *testing.T) {
+	since := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	at := since.Add(time.Hour)
+	muted := Line{State: LineMuted, Since: since, Observed: LineOn, ObservedSince: since}
+
+	tests := []struct {
+		name     string
+		line     Line
+		input    LineInput
+		changed  bool
+		state    LineState
+		observed LineState
+		from     LineState
+		to       LineState
+		notify   bool
+	}{
+		{"unknown power on", NewLine(), InputPowerOn, true, LineOn, LineOn, LineUnknown, LineOn, false},
+		{"unknown power off", NewLine(), InputPowerOff, true, LineOff, LineOff, LineUnknown, LineOff, false},
+		{"unknown lost", NewLine(), InputLost, true, LineUnreachable, LineUnreachable, LineUnknown, LineUnreachable, false},
+		{"unknown mute", NewLine(), InputMute, true, LineMuted, LineUnknown, LineUnknown, LineMuted, false},
+		{"unknown unmute", NewLine(), InputUnmute, false, LineUnknown, LineUnknown, "", "", false},
+		{"zero value power on", Line{}, InputPowerOn, true, LineOn, LineOn, LineUnknown, LineOn, false},
+
+		{"on power on", RestoredLine(LineOn, since), InputPowerOn, false, LineOn, LineOn, "", "", false},
+		{"on power off", RestoredLine(LineOn, since), InputPowerOff, true, LineOff, LineOff, LineOn, LineOff, true},
+		{"on lost", RestoredLine(LineOn, since), InputLost, true, LineUnreachable, LineUnreachable, LineOn, LineUnreachable, true},
+		{"on mute", RestoredLine(LineOn, since), InputMute, true, LineMuted, LineOn, LineOn, LineMuted, false},
+		{"on unmute", RestoredLine(LineOn, since), InputUnmute, false, LineOn, LineOn, "", "", false},
+
+		{"off power on", RestoredLine(LineOff, since), InputPowerOn, true, LineOn, LineOn, LineOff, LineOn, true},
+		{"off power off", RestoredLine(LineOff, since), InputPowerOff, false, LineOff, LineOff, "", "", false},
+		{"off lost", RestoredLine(LineOff, since), InputLost, true, LineUnreachable, LineUnreachable, LineOff, LineUnreachable, true},
+		{"off mute", RestoredLine(LineOff, since), InputMute, true, LineMuted, LineOff, LineOff, LineMuted, false},
+		{"off unmute", RestoredLine(LineOff, since), InputUnmute, false, LineOff, LineOff, "", "", false},
+
+		{"unreachable power on", RestoredLine(LineUnreachable, since), InputPowerOn, true, LineOn, LineOn, LineUnreachable, LineOn, true},
+		{"unreachable power off", RestoredLine(LineUnreachable, since), InputPowerOff, true, LineOff, LineOff, LineUnreachable, LineOff, true},
+		{"unreachable lost", RestoredLine(LineUnreachable, since), InputLost, false, LineUnreachable, LineUnreachable, "", "", false},
+		{"unreachable mute", RestoredLine(LineUnreachable, since), InputMute, true, LineMuted, LineUnreachable, LineUnreachable, LineMuted, false},
+		{"unreachable unmute", RestoredLine(LineUnreachable, since), InputUnmute, false, LineUnreachable, LineUnreachable, "", "", false},
+
+		{"muted power on", muted, InputPowerOn, false, LineMuted, LineOn, "", "", false},
+		{"muted power off", muted, InputPowerOff, true, LineMuted, LineOff, LineOn, LineOff, false},
+		{"muted lost", muted, InputLost, true, LineMuted, LineUnreachable, LineOn, LineUnreachable, false},
+		{"muted mute", muted, InputMute, false, LineMuted, LineOn, "", "", false},
+		{"muted unmute", muted, InputUnmute, true, LineOn, LineOn, LineMuted, LineOn, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := tt.line
+			before := line
+			event, changed := line.Apply(tt.input, at)
+
+			if changed != tt.changed {
+				t.Fatalf("changed = %v, want %v", changed, tt.changed)
+			}
+
+			if line.State != tt.state || line.Observed != tt.observed {
+				t.Fatalf("state = %s/%s, want %s/%s", line.State, line.Observed, tt.state, tt.observed)
+			}
+
+			if !changed {
+				if before.State != "" && line != before {
+					t.Fatalf("line changed without event: %+v", line)
+				}
+
+				return
+			}
+
+			if event.Input != tt.input || event.From != tt.from || event.To != tt.to || !event.At.Equal(at) {
+				t.Fatalf("event = %+v, want %s -> %s", event, tt.from, tt.to)
+			}
+
+			if event.ShouldNotify() != tt.notify {
+				t.Fatalf("notify = %v, want %v", event.ShouldNotify(), tt.notify)
+			}
+
+			if tt.from != LineUnknown && !event.PreviousSince.Equal(since) {
+				t.Fatalf("previous since = %s, want %s", event.PreviousSince, since)
+			}
+
+			if line.State != before.State && !line.Since.Equal(at) {
+				t.Fatalf("since = %s, want %s", line.Since, at)
+			}
+
+			if line.Observed != before.Observed && !line.ObservedSince.Equal(at) {
+				t.Fatalf("observed since = %s, want %s", line.ObservedSince, at)
+			}
+		})
+	}
+}
+
+func TestLineMutedKeepsObservedState(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	line := RestoredLine(LineOn, start)
+
+	line.Apply(InputMute, start.Add(time.Minute))
+	line.Apply(InputPowerOff, start.Add(2*time.Minute))
+	event, _ := line.Apply(InputUnmute, start.Add(3*time.Minute))
+
+	if event.To != LineOff || line.State != LineOff {
+		t.Fatalf("unmute returned to %s, want off", line.State)
+	}
+
+	if !line.ObservedSince.Equal(start.Add(2 * time.Minute)) {
+		t.Fatalf("observed since = %s", line.ObservedSince)
+	}
+
+	event, changed := line.Apply(InputPowerOn, start.Add(4*time.Minute))
+
+	if !changed || !event.ShouldNotify() {
+		t.Fatalf("power on after unmute must notify, got %+v", event)
+	}
+}
@@ -2,47 +2,100 @@ package comunication
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"time"
 )
 
 type Device struct {
-	Name                 string    `json:"n"`
-	Key                  string    `json:"k"`
-	Interval             int64     `json:"i"`
-	MacAddress           string    `json:"m"`
-	LastSeen             time.Time `json:"lastSeen"`
-	PowerOffAt           time.Time `json:"powerOffAt"`
-	Timeout              int64     `json:"timeout,omitempty"`
-	DownNotificationSend bool      `json:"downNotificationSend"`
-	UpNotificationSend   bool      `json:"upNotificationSend"`
-	PowerOnAt            time.Time `json:"powerOnAt"`
-	Complex              Complex   `json:"complex"`
-	HasDirectWire        bool      `json:"h"`
-	IsPluggedIn          bool      `json:"p"`
-	NotificationEnabled  bool      `json:"notification_enabled"`
+	Name                string        `json:"n"`
+	Key                 string        `json:"k"`
+	Interval            int64         `json:"i"`
+	MacAddress          string        `json:"m"`
+	LastSeen            time.Time     `json:"lastSeen"`
+	PowerOffAt          time.Time     `json:"powerOffAt"`
+	Timeout             int64         `json:"timeout,omitempty"`
+	PowerOnAt           time.Time     `json:"powerOnAt"`
+	Complex             Complex       `json:"complex"`
+	HasDirectWire       bool          `json:"h"`
+	IsHybrid            bool          `json:"hybrid"`
+	IsPluggedIn         bool          `json:"p"`
+	NotificationEnabled bool          `json:"notification_enabled"`
+	Telemetry           *Telemetry    `json:"telemetry,omitempty"`
+	Arrivals            ArrivalStats  `json:"arrivals"`
+	Line                Line          `json:"line"`
+	Events              []DeviceEvent `json:"e,omitempty"`
+}
+
+// DeviceEvent is a power change the device queued while it had no connection, t is unix seconds of the device clock
+type DeviceEvent struct {
+	At          int64 `json:"t"`
+	IsPluggedIn bool  `json:"p"`
+}
+
+type Telemetry struct {
+	BatteryLevel   uint32  `json:"battery_level,omitempty"`
+	Voltage        float64 `json:"voltage,omitempty"`
+	BatteryRuntime int64   `json:"battery_runtime_s,omitempty"`
+	LowBattery     bool    `json:"low_battery,omitempty"`
+	UpsStatus      string  `json:"ups_status,omitempty"`
 }
 
 type Complex struct {
-	Key                 string           `json:"key" yaml:"key"`
-	Name                string           `json:"name" yaml:"name"`
-	BotToken            string           `json:"bot_token" yaml:"bot_token"`
-	BotChannels         []int64          `json:"bot_channels" yaml:"bot_channels"`
-	BotIdentity         string           `json:"bot_identity" yaml:"bot_identity"`
-	NotificationEnabled bool             `json:"notification_enabled" yaml:"notification_enabled"`
-	StatisticsEnabled   bool             `json:"statistics_enabled" yaml:"statistics_enabled"`
-	StatisticsKey       string           `json:"statistics_key" yaml:"statistics_key"`
-	DeviceGroupMap      map[string]int64 `json:"device_group_map" yaml:"device_group_map"`
-	IsDirectWire        bool             `json:"is_direct_wire" yaml:"is_direct_wire"`
+	Key                 string                   `json:"key" yaml:"key"`
+	Name                string                   `json:"name" yaml:"name"`
+	BotToken            string                   `json:"bot_token" yaml:"bot_token"`
+	BotChannels         []int64                  `json:"bot_channels" yaml:"bot_channels"`
+	BotIdentity         string                   `json:"bot_identity" yaml:"bot_identity"`
+	NotificationEnabled bool                     `json:"notification_enabled" yaml:"notification_enabled"`
+	StatisticsEnabled   bool                     `json:"statistics_enabled" yaml:"statistics_enabled"`
+	StatisticsKey       string                   `json:"statistics_key" yaml:"statistics_key"`
+	DeviceGroupMap      map[string]int64         `json:"device_group_map" yaml:"device_group_map"`
+	IsDirectWire        bool                     `json:"is_direct_wire" yaml:"is_direct_wire"`
+	WebhookSecret       string                   `json:"-" yaml:"webhook_secret"`
+	UsePolling          bool                     `json:"use_polling" yaml:"use_polling"`
+	AdminIds            []int64                  `json:"admin_ids" yaml:"admin_ids"`
+	MuteExpiredNotice   bool                     `json:"mute_expired_notice" yaml:"mute_expired_notice"`
+	FollowUpHours       []int64                  `json:"follow_up_hours" yaml:"follow_up_hours"`
+	FollowUpChannels    []int64                  `json:"follow_up_channels" yaml:"follow_up_channels"`
+	OperatorChannels    []int64                  `json:"operator_channels" yaml:"operator_channels"`
+	Probes              []Probe                  `json:"probes" yaml:"probes"`
+	BackfillSummary     bool                     `json:"backfill_summary" yaml:"backfill_summary"`
+	TimeoutPolicy       TimeoutPolicy            `json:"timeout_policy" yaml:"timeout_policy"`
+	DeviceTimeouts      map[string]TimeoutPolicy `json:"device_timeouts" yaml:"device_timeouts"`
+}
+
+// TimeoutPolicy tunes when a timeout based line is considered without power, zero values are inherited
+type TimeoutPolicy struct {
+	IntervalMultiplier float64 `json:"interval_multiplier" yaml:"interval_multiplier"`
+	MinTimeout         int64   `json:"min_timeout" yaml:"min_timeout"`
+	Grace              int64   `json:"grace" yaml:"grace"`
+}
+
+// Probe is a line watched by connecting to hosts that lose power together with it, e.g. an apartment router
+type Probe struct {
+	Id       string   `json:"id" yaml:"id"`
+	Name     string   `json:"name" yaml:"name"`
+	Targets  []string `json:"targets" yaml:"targets"`
+	Interval int64    `json:"interval" yaml:"interval"`
+	Failures int      `json:"failures" yaml:"failures"`
+	Timeout  int64    `json:"timeout" yaml:"timeout"`
 }
 
 type DeviceInfo struct {
-	Name              string    `json:"name"`
-	UpdateInterval    int64     `json:"updateInterval"`
-	CalculatedTimeout int64     `json:"calculatedTimeout"`
-	IsOnline          bool      `json:"isOnline"`
-	LastSeen          time.Time `json:"lastSeen"`
+	Name              string     `json:"name"`
+	State             LineState  `json:"state"`
+	UpdateInterval    int64      `json:"updateInterval"`
+	CalculatedTimeout int64      `json:"calculatedTimeout"`
+	LearnedTimeout    int64      `json:"learnedTimeout"`
+	MeanInterval      float64    `json:"meanInterval"`
+	Jitter            float64    `json:"jitter"`
+	MaxGap            float64    `json:"maxGap"`
+	Samples           int        `json:"samples"`
+	IsOnline          bool       `json:"isOnline"`
+	LastSeen          time.Time  `json:"lastSeen"`
+	Telemetry         *Telemetry `json:"telemetry,omitempty"`
 }
 
 type ComplexInfo struct {
@@ -85,6 +138,11 @@ func (d Device) IsTimeout() bool {
 	return (time.Now().Unix() - d.LastSeen.Unix()) > d.Timeout
 }
 
+// TimeoutAt is the first moment IsTimeout reports true
+func (d Device) TimeoutAt() time.Time {
+	return time.Unix(d.LastSeen.Unix()+d.Timeout+1, 0)
+}
+
 func (d Device) GeneratePowerOffMessageOnline() string {
 	since := time.Since(d.PowerOnAt)
 
@@ -109,23 +167,100 @@ func (d Device) GeneratePowerOnMessage() string {
 	return fmt.Sprintf("\"%s %s\" живлення з'явилось о %s. Світла не було %s", d.Name, d.Complex.Name, time.Now().Format("15:04:05"), since.Round(time.Second).String())
 }
 
+func (d Device) GenerateFollowUpMessage(since time.Time, now time.Time) string {
+	hours := int64(now.Sub(since).Hours())
+
+	return fmt.Sprintf("\"%s %s\" досі без живлення %d год. (з %s)", d.Name, d.Complex.Name, hours, since.Format("2006-01-02 15:04"))
+}
+
+func (d Device) GenerateDowntimeOffMessage(restartedAt time.Time) string {
+	return fmt.Sprintf("\"%s %s\" немає даних після перезапуску сервера о %s. Останні дані о %s, стан під час простою сервера невідомий", d.Name, d.Complex.Name, restartedAt.Format("15:04"), d.LastSeen.Format("2006-01-02 15:04"))
+}
+
+func (d Device) GenerateMonitoringLostMessage() string {
+	return fmt.Sprintf("\"%s %s\" немає даних від пристрою з %s. Стан живлення невідомий", d.Name, d.Complex.Name, d.LastSeen.Format("15:04:05"))
+}
+
+func (d Device) GenerateMonitoringRestoredMessage() string {
+	state := "живлення є"
+	if !d.IsPluggedIn {
+		state = "живлення немає"
+	}
+
+	return fmt.Sprintf("\"%s %s\" зв'язок з пристроєм відновлено о %s, %s", d.Name, d.Complex.Name, time.Now().Format("15:04"), state)
+}
+
+// GenerateStatusMessage renders the observed state of the line, a muted line keeps reporting it
 func (d Device) GenerateStatusMessage() string {
-	if d.IsTimeout() {
-		return fmt.Sprintf("%s вимкнена з %s", d.Name, d.LastSeen.Format("2006-01-02 15:04:05"))
-	} else {
-		return fmt.Sprintf("%s увімкнена з %s", d.Name, d.PowerOnAt.Format("2006-01-02 15:04:05"))
+	status := observedStatus(d.Name, d.Line.Observed, d.Line.ObservedSince)
+
+	if d.Line.IsMuted() {
+		return fmt.Sprintf("%s (сповіщення вимкнено)", status)
 	}
+
+	return status
+}
+
+func observedStatus(name string, state LineState, since time.Time) string {
+	switch state {
+	case LineOn:
+		return fmt.Sprintf("%s увімкнена з %s", name, since.Format("2006-01-02 15:04:05"))
+	case LineOff:
+		return fmt.Sprintf("%s вимкнена з %s", name, since.Format("2006-01-02 15:04:05"))
+	case LineUnreachable:
+		return fmt.Sprintf("%s: немає даних від пристрою з %s", name, since.Format("2006-01-02 15:04:05"))
+	}
+
+	return fmt.Sprintf("%s: стан невідомий", name)
 }
 
-func (d Device) GenerateStatusMessageOnline() string {
-	if d.IsPluggedIn {
-		return fmt.Sprintf("%s увімкнена з %s", d.Name, d.PowerOnAt.Format("2006-01-02 15:04:05"))
-	} else {
-		return fmt.Sprintf("%s вимкнена з %s", d.Name, d.PowerOffAt.Format("2006-01-02 15:04:05"))
+func (c Complex) IsAdmin(userId int64) bool {
+	for _, id := range c.AdminIds {
+		if id == userId {
+			return true
+		}
 	}
+
+	return false
 }
 
 func (d Device) Hash() string {
 	hash := md5.Sum([]byte(d.MacAddress))
 	return hex.EncodeToString(hash[:])
 }
+
+// DeviceTimeoutPolicy merges the policy of the device MAC over the complex one
+func (c Complex) DeviceTimeoutPolicy(mac string) TimeoutPolicy {
+	policy := c.TimeoutPolicy
+	override, ok := c.DeviceTimeouts[mac]
+
+	if !ok {
+		return policy
+	}
+
+	if override.IntervalMultiplier > 0 {
+		policy.IntervalMultiplier = override.IntervalMultiplier
+	}
+
+	if override.MinTimeout > 0 {
+		policy.MinTimeout = override.MinTimeout
+	}
+
+	if override.Grace > 0 {
+		policy.Grace = override.Grace
+	}
+
+	return policy
+}
+
+// SecretToken returns the value Telegram must send in X-Telegram-Bot-Api-Secret-Token.
+// When webhook_secret is not configured it is derived from the bot token, so it stays
+// stable between restarts and is never guessable from the bot identity alone.
+func (c Complex) SecretToken() string {
+	if c.WebhookSecret != "" {
+		return c.WebhookSecret
+	}
+
+	hash := sha256.Sum256([]byte(c.BotToken + ":" + c.BotIdentity))
+	return hex.EncodeToString(hash[:])
+}
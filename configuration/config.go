@@ -4,13 +4,26 @@ import (
 	"github.com/gin-gonic/gin"
 	"go-meshtastic-monitor/comunication"
 	"go-meshtastic-monitor/core"
+	"go-meshtastic-monitor/meshtastic"
+	"go-meshtastic-monitor/mqtt"
+	"go-meshtastic-monitor/nut"
+	"go-meshtastic-monitor/udp"
 )
 
 type Configuration struct {
-	Redis                  core.RedisConf         `yaml:"redis"`
-	TelegramWebhookPattern string                 `yaml:"telegram_webhook_pattern"`
-	Complexes              []comunication.Complex `yaml:"complexes"`
-	ConfigRereadInterval   int64                  `yaml:"config_reread_interval"`
-	HttpBind               string                 `yaml:"http_bind"`
-	HttpSecurity           gin.Accounts           `yaml:"http_security"`
+	Redis                  core.RedisConf            `yaml:"redis"`
+	TelegramWebhookPattern string                    `yaml:"telegram_webhook_pattern"`
+	Complexes              []comunication.Complex    `yaml:"complexes"`
+	ConfigRereadInterval   int64                     `yaml:"config_reread_interval"`
+	HttpBind               string                    `yaml:"http_bind"`
+	HttpSecurity           gin.Accounts              `yaml:"http_security"`
+	Operator               core.OperatorConf         `yaml:"operator"`
+	ScheduleFile           string                    `yaml:"schedule_file"`
+	OutgoingWebhooks       []core.WebhookTarget      `yaml:"outgoing_webhooks"`
+	Mqtt                   mqtt.MqttConf             `yaml:"mqtt"`
+	Meshtastic             meshtastic.MeshtasticConf `yaml:"meshtastic"`
+	Udp                    udp.UdpConf               `yaml:"udp"`
+	Nut                    []nut.Server              `yaml:"nut"`
+	AdaptiveTimeout        core.AdaptiveConf         `yaml:"adaptive_timeout"`
+	Correlation            core.CorrelationConf      `yaml:"correlation"`
 }
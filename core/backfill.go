@@ -0,0 +1,87 @@
+package core
+
+import (
+	"fmt"
+	"go-meshtastic-monitor/comunication"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxBackfillSkew is how far in the future a device clock may be before its events are dropped
+const MaxBackfillSkew = 5 * time.Minute
+
+// Backfill applies power changes the device recorded while it had no connection. It is called before
+// the heartbeat that ends the silence, so the events replace the span the server could only guess.
+// Events not newer than the current state of the line or the last data from the device overlap with
+// what the server recorded itself and are dropped, a live heartbeat after an event wins.
+// Residents are not notified about them, complexes with BackfillSummary get one summary message instead.
+func (n *Notifier) Backfill(d *comunication.Device, events []comunication.DeviceEvent, now time.Time) []Transition {
+	events = append([]comunication.DeviceEvent(nil), events...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].At < events[j].At
+	})
+
+	var transitions []Transition
+
+	for _, e := range events {
+		at := time.Unix(e.At, 0)
+
+		if e.At <= 0 || at.After(now.Add(MaxBackfillSkew)) {
+			continue
+		}
+
+		if !at.After(d.Line.ObservedSince) || !at.After(d.LastSeen) {
+			continue
+		}
+
+		input := comunication.InputPowerOff
+		if e.IsPluggedIn {
+			input = comunication.InputPowerOn
+		}
+
+		event, changed := d.Line.Apply(input, at)
+
+		if !changed {
+			continue
+		}
+
+		d.IsPluggedIn = e.IsPluggedIn
+		if e.IsPluggedIn {
+			d.PowerOnAt = at
+		} else {
+			d.PowerOffAt = at
+		}
+
+		t := NewLineTransition(*d, event)
+		t.Backfilled = true
+		transitions = append(transitions, t)
+	}
+
+	for _, t := range transitions {
+		n.Transition(t)
+	}
+
+	if len(transitions) > 0 && d.Complex.BackfillSummary {
+		n.Notify(Notification{
+			Device:  *d,
+			Message: backfillSummary(*d, transitions),
+		})
+	}
+
+	return transitions
+}
+
+func backfillSummary(d comunication.Device, transitions []Transition) string {
+	msgs := []string{fmt.Sprintf("\"%s %s\" записано пристроєм під час відсутності зв'язку:", d.Name, d.Complex.Name)}
+
+	for _, t := range transitions {
+		if t.State == StateOn {
+			msgs = append(msgs, fmt.Sprintf("%s живлення з'явилось", t.At.Format("2006-01-02 15:04")))
+		} else {
+			msgs = append(msgs, fmt.Sprintf("%s живлення зникло", t.At.Format("2006-01-02 15:04")))
+		}
+	}
+
+	return strings.Join(msgs, "\n")
+}
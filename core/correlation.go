@@ -0,0 +1,266 @@
+package core
+
+import (
+	"fmt"
+	"go-meshtastic-monitor/comunication"
+	"time"
+)
+
+const DefaultCorrelationWindow = 60
+const DefaultCorrelationMinLines = 3
+const DefaultCorrelationRatio = 0.8
+const DeploymentIncident = "*"
+
+// CorrelationConf enables holding power off of timeout devices for Window seconds to see whether
+// the line went silent together with most of its complex or of the whole deployment.
+type CorrelationConf struct {
+	Enabled  bool    `yaml:"enabled"`
+	Window   int64   `yaml:"window"`
+	MinLines int     `yaml:"min_lines"`
+	Ratio    float64 `yaml:"ratio"`
+}
+
+type incident struct {
+	device    comunication.Device
+	since     time.Time
+	lines     map[string]bool
+	resumedAt time.Time
+}
+
+// Correlator tells a mass silence (ISP or server trouble) from a power off. Silent lines of such an
+// incident become unreachable, residents get one message per complex instead of one per line and
+// operators are alerted. When data resumes, lines still silent after the window are real outages.
+// It is used by Monitor under its lock.
+type Correlator struct {
+	conf      CorrelationConf
+	n         *Notifier
+	held      map[string]time.Time
+	incidents map[string]*incident
+	lines     map[string]string
+}
+
+func NewCorrelator(notifier *Notifier) *Correlator {
+	return &Correlator{
+		n:         notifier,
+		held:      make(map[string]time.Time),
+		incidents: make(map[string]*incident),
+		lines:     make(map[string]string),
+	}
+}
+
+func (c *Correlator) SetConf(conf CorrelationConf) {
+	if conf.Window <= 0 {
+		conf.Window = DefaultCorrelationWindow
+	}
+
+	if conf.MinLines <= 0 {
+		conf.MinLines = DefaultCorrelationMinLines
+	}
+
+	if conf.Ratio <= 0 || conf.Ratio > 1 {
+		conf.Ratio = DefaultCorrelationRatio
+	}
+
+	c.conf = conf
+}
+
+func (m *Monitor) SetCorrelation(conf CorrelationConf) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	m.c.SetConf(conf)
+}
+
+func (c *Correlator) window() time.Duration {
+	return time.Duration(c.conf.Window) * time.Second
+}
+
+// Hold returns until when the power off of the line waits for the other lines, false once it may be decided
+func (c *Correlator) Hold(mac string, now time.Time) (time.Time, bool) {
+	if !c.conf.Enabled {
+		return time.Time{}, false
+	}
+
+	until, ok := c.held[mac]
+
+	if !ok {
+		until = now.Add(c.window())
+		c.held[mac] = until
+	}
+
+	if now.Before(until) {
+		return until, true
+	}
+
+	delete(c.held, mac)
+
+	return time.Time{}, false
+}
+
+// Correlated decides whether the silent device is a part of a mass silence and registers it in the incident
+func (c *Correlator) Correlated(device comunication.Device, devices map[string]comunication.Device, now time.Time) bool {
+	if !c.conf.Enabled {
+		return false
+	}
+
+	// only lines that went silent around the same moment count, not the ones off or dead for long
+	start := device.LastSeen
+	silent := func(d comunication.Device) bool {
+		gap := d.LastSeen.Sub(start)
+
+		return gap <= c.window() && -gap <= c.window() && !now.Before(d.TimeoutAt())
+	}
+
+	var total, silentCount, complexTotal, complexSilent int
+	complexes := make(map[string]bool)
+
+	for _, d := range devices {
+		total++
+		complexes[d.Key] = true
+		isSilent := silent(d)
+
+		if isSilent {
+			silentCount++
+		}
+
+		if d.Key == device.Key {
+			complexTotal++
+
+			if isSilent {
+				complexSilent++
+			}
+		}
+	}
+
+	if len(complexes) > 1 && c.isMass(silentCount, total) {
+		c.register(DeploymentIncident, device, total)
+
+		return true
+	}
+
+	if c.isMass(complexSilent, complexTotal) {
+		c.register(device.Key, device, complexTotal)
+
+		return true
+	}
+
+	return false
+}
+
+func (inc *incident) alertKey(kind string, key string) string {
+	return fmt.Sprintf("correlation_%s:%s:%d", kind, key, inc.since.Unix())
+}
+
+func (c *Correlator) isMass(silent int, total int) bool {
+	return total >= c.conf.MinLines && float64(silent) >= c.conf.Ratio*float64(total)
+}
+
+func (c *Correlator) register(key string, device comunication.Device, total int) {
+	inc, ok := c.incidents[key]
+
+	if !ok {
+		inc = &incident{device: device, since: device.LastSeen, lines: make(map[string]bool)}
+		c.incidents[key] = inc
+
+		if key == DeploymentIncident {
+			c.n.Alert(comunication.Complex{}, inc.alertKey("lost", key), fmt.Sprintf("Одночасно зник зв'язок з %d ліній в усіх комплексах о %s. Ймовірно, проблема з сервером чи провайдером, сповіщення мешканцям не надсилаються", total, device.LastSeen.Format("15:04:05")))
+		} else {
+			c.n.Alert(device.Complex, inc.alertKey("lost", key), fmt.Sprintf("Одночасно зник зв'язок з лініями комплексу \"%s\" о %s. Ймовірно, проблема з інтернетом, а не відключення світла", device.Complex.Name, device.LastSeen.Format("15:04:05")))
+			c.n.Notify(Notification{
+				Device:  device,
+				Message: fmt.Sprintf("\"%s\" одночасно зник зв'язок з усіма лініями о %s. Ймовірно, проблема з інтернетом, стан живлення невідомий", device.Complex.Name, device.LastSeen.Format("15:04")),
+			})
+		}
+	}
+
+	inc.lines[device.MacAddress] = true
+	c.lines[device.MacAddress] = key
+}
+
+// Resumed is called when an unreachable line reports again, it returns false for lines outside an incident
+// and the lines left in the incident, which are checked again once the window passes.
+func (c *Correlator) Resumed(mac string, now time.Time) (bool, []string, time.Time) {
+	delete(c.held, mac)
+	key, ok := c.lines[mac]
+
+	if !ok {
+		return false, nil, time.Time{}
+	}
+
+	delete(c.lines, mac)
+	inc := c.incidents[key]
+	delete(inc.lines, mac)
+
+	if len(inc.lines) == 0 {
+		c.close(key, inc)
+
+		return true, nil, time.Time{}
+	}
+
+	if !inc.resumedAt.IsZero() {
+		return true, nil, time.Time{}
+	}
+
+	inc.resumedAt = now
+	var left []string
+	for line := range inc.lines {
+		left = append(left, line)
+	}
+
+	return true, left, now.Add(c.window())
+}
+
+// Reconcile tells whether a line of an incident stayed silent long after the others resumed,
+// such a line is removed from the incident and reported as without power. Otherwise the time of the next check is returned.
+// Incidents are not persisted, an unreachable line without one (e.g. after a restart) is reported once
+// the window after since passes.
+func (c *Correlator) Reconcile(mac string, since time.Time, now time.Time) (bool, time.Time) {
+	key, ok := c.lines[mac]
+
+	if !ok {
+		if until := since.Add(c.window()); now.Before(until) {
+			return false, until
+		}
+
+		return true, time.Time{}
+	}
+
+	inc := c.incidents[key]
+
+	if inc.resumedAt.IsZero() {
+		return false, time.Time{}
+	}
+
+	if until := inc.resumedAt.Add(c.window()); now.Before(until) {
+		return false, until
+	}
+
+	delete(c.lines, mac)
+	delete(inc.lines, mac)
+
+	if len(inc.lines) == 0 {
+		c.close(key, inc)
+	}
+
+	return true, time.Time{}
+}
+
+// Seen drops the hold of a line that reported in time
+func (c *Correlator) Seen(mac string) {
+	delete(c.held, mac)
+}
+
+func (c *Correlator) close(key string, inc *incident) {
+	delete(c.incidents, key)
+
+	if key == DeploymentIncident {
+		c.n.Alert(comunication.Complex{}, inc.alertKey("restored", key), fmt.Sprintf("Зв'язок з лініями відновлено, втрата тривала %s", time.Since(inc.since).Round(time.Second).String()))
+
+		return
+	}
+
+	c.n.Alert(inc.device.Complex, inc.alertKey("restored", key), fmt.Sprintf("Зв'язок з лініями комплексу \"%s\" відновлено", inc.device.Complex.Name))
+	c.n.Notify(Notification{
+		Device:  inc.device,
+		Message: fmt.Sprintf("\"%s\" зв'язок з лініями відновлено о %s", inc.device.Complex.Name, time.Now().Format("15:04")),
+	})
+}
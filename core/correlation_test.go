@@ -0,0 +1,201 @@
+package core
+
+import (
+	"fmt"
+	"go-meshtastic-monitor/comunication"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedTransitions struct {
+	rw    sync.Mutex
+	items []Transition
+}
+
+func (r *recordedTransitions) HandleTransition(t Transition) {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	r.items = append(r.items, t)
+}
+
+func (r *recordedTransitions) states(mac string) string {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+
+	var states []string
+	for _, t := range r.items {
+		if t.MacAddress == mac {
+			states = append(states, t.State)
+		}
+	}
+
+	return strings.Join(states, ",")
+}
+
+func (r *recordedTransitions) len() int {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+
+	return len(r.items)
+}
+
+func drainNotifications(n *Notifier) []string {
+	var messages []string
+
+	for {
+		select {
+		case notification := <-n.notifications:
+			messages = append(messages, notification.Message)
+		default:
+			return messages
+		}
+	}
+}
+
+// newCorrelatedMonitor has lines on with the given last heartbeats, the deadline callback is called by the tests
+func newCorrelatedMonitor(lastSeen map[string]time.Time) (*Monitor, *recordedTransitions) {
+	notifier := NewNotifier("", OperatorConf{}, nil)
+	transitions := &recordedTransitions{}
+	notifier.AddTransitionHandler(transitions)
+
+	c := comunication.Complex{Key: "k", Name: "Дім", NotificationEnabled: true}
+	m := NewMonitor([]comunication.Complex{c}, notifier, nil, nil)
+	m.SetCorrelation(CorrelationConf{Enabled: true})
+
+	for mac, at := range lastSeen {
+		m.devices[mac] = comunication.Device{
+			Key:                 c.Key,
+			Name:                mac,
+			MacAddress:          mac,
+			Interval:            10,
+			Timeout:             10 * IntervalCoefficient,
+			Complex:             c,
+			LastSeen:            at,
+			PowerOnAt:           at.Add(-time.Hour),
+			IsPluggedIn:         true,
+			NotificationEnabled: true,
+			Line:                comunication.RestoredLine(comunication.LineOn, at.Add(-time.Hour)),
+		}
+	}
+
+	return m, transitions
+}
+
+// passWindow ends the holds as if the correlation window passed
+func passWindow(m *Monitor) {
+	for mac := range m.c.held {
+		m.c.held[mac] = time.Now().Add(-time.Second)
+	}
+}
+
+func checkAll(m *Monitor) {
+	for mac := range m.devices {
+		m.checkDevice(mac, time.Now())
+	}
+}
+
+func TestMassSilenceMakesLinesUnreachable(t *testing.T) {
+	now := time.Now()
+	lastSeen := make(map[string]time.Time)
+	for i := 0; i < 5; i++ {
+		lastSeen[fmt.Sprintf("line-%d", i)] = now.Add(-time.Duration(100+i*10) * time.Second)
+	}
+
+	m, transitions := newCorrelatedMonitor(lastSeen)
+
+	// the first check only holds the power off for the window
+	checkAll(m)
+	if transitions.len() != 0 {
+		t.Fatalf("%d transitions during the hold", transitions.len())
+	}
+
+	passWindow(m)
+	checkAll(m)
+
+	for mac := range lastSeen {
+		if got := transitions.states(mac); got != "unreachable" {
+			t.Fatalf("%s transitions %s, want unreachable", mac, got)
+		}
+	}
+
+	// residents get one message for the complex instead of one per line
+	if messages := drainNotifications(m.n); len(messages) != 1 {
+		t.Fatalf("notifications %v, want one for the complex", messages)
+	}
+}
+
+func TestLinesOffForLongAreNotPartOfMassSilence(t *testing.T) {
+	now := time.Now()
+	m, transitions := newCorrelatedMonitor(map[string]time.Time{
+		"line": now.Add(-100 * time.Second),
+		"on":   now,
+	})
+
+	for i := 1; i <= 3; i++ {
+		mac := fmt.Sprintf("dead-%d", i)
+		at := now.Add(-time.Duration(i*10) * time.Hour)
+		m.devices[mac] = comunication.Device{
+			Key:        "k",
+			Name:       mac,
+			MacAddress: mac,
+			Interval:   10,
+			Timeout:    10 * IntervalCoefficient,
+			Complex:    m.complexes["k"],
+			LastSeen:   at,
+			Line:       comunication.RestoredLine(comunication.LineOff, at),
+		}
+	}
+
+	m.checkDevice("line", now)
+	passWindow(m)
+	m.checkDevice("line", now)
+
+	// only the lines silent around the same moment count, the line is off and not unreachable
+	if got := transitions.states("line"); got != "off" {
+		t.Fatalf("transitions %s, want off", got)
+	}
+
+	if messages := drainNotifications(m.n); len(messages) != 1 {
+		t.Fatalf("notifications %v, want the power off of the line", messages)
+	}
+}
+
+func TestHeldLineReportingEndsHoldWithoutTransitions(t *testing.T) {
+	now := time.Now()
+	m, transitions := newCorrelatedMonitor(map[string]time.Time{
+		"line": now.Add(-time.Minute),
+		"a":    now,
+		"b":    now,
+	})
+
+	m.checkDevice("line", now)
+	if _, held := m.c.held["line"]; !held {
+		t.Fatal("silent line is not held")
+	}
+
+	m.AddDevice(comunication.Device{Key: "k", Name: "line", MacAddress: "line", Interval: 10})
+
+	if transitions.len() != 0 {
+		t.Fatalf("transitions %s after the held line reported", transitions.states("line"))
+	}
+
+	if _, held := m.c.held["line"]; held {
+		t.Fatal("hold is kept after the line reported")
+	}
+
+	if messages := drainNotifications(m.n); len(messages) != 0 {
+		t.Fatalf("notifications %v after the held line reported", messages)
+	}
+
+	// the next silence starts a new hold instead of using the old one
+	device := m.devices["line"]
+	device.LastSeen = now.Add(-time.Minute)
+	m.devices["line"] = device
+	m.checkDevice("line", now)
+
+	if transitions.len() != 0 {
+		t.Fatalf("transitions %s without a new hold", transitions.states("line"))
+	}
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type deadline struct {
+	key   string
+	at    time.Time
+	index int
+}
+
+type deadlineHeap []*deadline
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *deadlineHeap) Push(x any) {
+	item := x.(*deadline)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	item.index = -1
+
+	return item
+}
+
+// Deadlines calls fire once the deadline of a key is reached. A key has at most one deadline,
+// scheduling it again moves the deadline. fire is called from the Start goroutine without locks held.
+type Deadlines struct {
+	mu       sync.Mutex
+	heap     deadlineHeap
+	items    map[string]*deadline
+	fire     func(key string, at time.Time)
+	wake     chan struct{}
+	stopChan chan struct{}
+}
+
+func NewDeadlines(fire func(key string, at time.Time)) *Deadlines {
+	return &Deadlines{
+		items:    make(map[string]*deadline),
+		fire:     fire,
+		wake:     make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+	}
+}
+
+func (d *Deadlines) Schedule(key string, at time.Time) {
+	d.mu.Lock()
+	item, ok := d.items[key]
+
+	if ok {
+		item.at = at
+		heap.Fix(&d.heap, item.index)
+	} else {
+		item = &deadline{key: key, at: at}
+		d.items[key] = item
+		heap.Push(&d.heap, item)
+	}
+
+	first := item.index == 0
+	d.mu.Unlock()
+
+	if first {
+		d.notify()
+	}
+}
+
+func (d *Deadlines) Cancel(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	item, ok := d.items[key]
+
+	if !ok {
+		return
+	}
+
+	heap.Remove(&d.heap, item.index)
+	delete(d.items, key)
+}
+
+func (d *Deadlines) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.heap)
+}
+
+func (d *Deadlines) Start() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		for _, item := range d.due(time.Now()) {
+			d.fire(item.key, item.at)
+		}
+
+		wait, ok := d.next(time.Now())
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		if ok {
+			timer.Reset(wait)
+		}
+
+		select {
+		case <-timer.C:
+		case <-d.wake:
+		case <-d.stopChan:
+			return
+		}
+	}
+}
+
+func (d *Deadlines) Stop() {
+	d.stopChan <- struct{}{}
+}
+
+func (d *Deadlines) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Deadlines) due(now time.Time) []*deadline {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var items []*deadline
+	for len(d.heap) > 0 && !d.heap[0].at.After(now) {
+		item := heap.Pop(&d.heap).(*deadline)
+		delete(d.items, item.key)
+		items = append(items, item)
+	}
+
+	return items
+}
+
+func (d *Deadlines) next(now time.Time) (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.heap) == 0 {
+		return 0, false
+	}
+
+	return d.heap[0].at.Sub(now), true
+}
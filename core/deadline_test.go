@@ -0,0 +1,120 @@
+package core
+
+import (
+	"fmt"
+	"go-meshtastic-monitor/comunication"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const benchmarkDevices = 10000
+
+func TestDeadlinesFireInOrder(t *testing.T) {
+	fired := make(chan string, 3)
+	d := NewDeadlines(func(key string, at time.Time) {
+		fired <- key
+	})
+	go d.Start()
+	defer d.Stop()
+
+	now := time.Now()
+	d.Schedule("c", now.Add(30*time.Millisecond))
+	d.Schedule("a", now.Add(10*time.Millisecond))
+	d.Schedule("b", now.Add(time.Hour))
+	d.Schedule("b", now.Add(20*time.Millisecond))
+	d.Schedule("x", now.Add(5*time.Millisecond))
+	d.Cancel("x")
+
+	for _, want := range []string{"a", "b", "c"} {
+		select {
+		case key := <-fired:
+			if key != want {
+				t.Fatalf("fired %s, want %s", key, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s did not fire", want)
+		}
+	}
+
+	if d.Len() != 0 {
+		t.Fatalf("%d deadlines left", d.Len())
+	}
+}
+
+// BenchmarkDeadlinesHeartbeat is the cost of a heartbeat moving the deadline of one of 10k devices.
+func BenchmarkDeadlinesHeartbeat(b *testing.B) {
+	d := NewDeadlines(func(key string, at time.Time) {})
+	now := time.Now()
+	keys := make([]string, benchmarkDevices)
+
+	for i := range keys {
+		keys[i] = fmt.Sprintf("device-%d", i)
+		d.Schedule(keys[i], now.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Schedule(keys[i%benchmarkDevices], now.Add(time.Duration(benchmarkDevices+i)*time.Millisecond))
+	}
+}
+
+// BenchmarkDeadlinesLatency fires 10k deadlines spread over 100ms and reports how late they fired.
+func BenchmarkDeadlinesLatency(b *testing.B) {
+	var late, maxLate int64
+	var wg sync.WaitGroup
+	d := NewDeadlines(func(key string, at time.Time) {
+		delay := int64(time.Since(at))
+		atomic.AddInt64(&late, delay)
+
+		for {
+			current := atomic.LoadInt64(&maxLate)
+			if delay <= current || atomic.CompareAndSwapInt64(&maxLate, current, delay) {
+				break
+			}
+		}
+
+		wg.Done()
+	})
+	go d.Start()
+	defer d.Stop()
+
+	for i := 0; i < b.N; i++ {
+		now := time.Now()
+		wg.Add(benchmarkDevices)
+
+		for j := 0; j < benchmarkDevices; j++ {
+			d.Schedule(fmt.Sprintf("device-%d", j), now.Add(time.Duration(j%100)*time.Millisecond))
+		}
+
+		wg.Wait()
+	}
+
+	b.ReportMetric(float64(late)/float64(b.N*benchmarkDevices), "ns-late/deadline")
+	b.ReportMetric(float64(maxLate), "ns-max-late")
+}
+
+// BenchmarkPeriodicScan is one round of the former check: every device under the lock, every 10 seconds,
+// so a power off was reported up to 10 seconds late.
+func BenchmarkPeriodicScan(b *testing.B) {
+	var rw sync.RWMutex
+	now := time.Now()
+	devices := make(map[string]comunication.Device)
+
+	for i := 0; i < benchmarkDevices; i++ {
+		mac := fmt.Sprintf("device-%d", i)
+		devices[mac] = comunication.Device{MacAddress: mac, LastSeen: now, Timeout: 90}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw.Lock()
+		for _, device := range devices {
+			if device.IsTimeout() {
+				b.Fatal("unexpected timeout")
+			}
+		}
+		rw.Unlock()
+	}
+}
@@ -0,0 +1,395 @@
+package core
+
+import (
+	"encoding/json"
+	"go-meshtastic-monitor/comunication"
+	"log"
+	"sync"
+	"time"
+)
+
+const SnapshotInterval = 60
+
+// devices written by one pipeline of a snapshot
+const snapshotBatch = 500
+
+// DeviceStore keeps every device of a monitor in its own Redis hash, written on each transition
+// and by periodic snapshots. Every field is decoded on its own, so a damaged field or a
+// half written hash loses only that part of the state.
+//
+// Save and Delete are called under the monitor lock and only queue the write, the Start goroutine
+// writes the latest queued state of every device, so a Redis outage does not stop the monitors.
+type DeviceStore struct {
+	storage *RedisStorage
+	prefix  string
+
+	mu      sync.Mutex
+	pending map[string]storeOp
+	deleted map[string]time.Time
+
+	// writeLock keeps queued writes and snapshots in order
+	writeLock sync.Mutex
+	wake      chan struct{}
+	stopChan  chan struct{}
+}
+
+type storeOp struct {
+	device comunication.Device
+	delete bool
+}
+
+func NewDeviceStore(storage *RedisStorage, prefix string) *DeviceStore {
+	return &DeviceStore{
+		storage:  storage,
+		prefix:   prefix,
+		pending:  make(map[string]storeOp),
+		deleted:  make(map[string]time.Time),
+		wake:     make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+	}
+}
+
+func (s *DeviceStore) Start() {
+	for {
+		select {
+		case <-s.wake:
+			s.Flush()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+func (s *DeviceStore) Stop() {
+	close(s.stopChan)
+}
+
+// Flush writes the queued devices, it is called by Start and before the final backup
+func (s *DeviceStore) Flush() {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.mu.Lock()
+	ops := s.pending
+	s.pending = make(map[string]storeOp)
+	s.mu.Unlock()
+
+	for mac, op := range ops {
+		if op.delete {
+			s.remove(mac)
+		} else {
+			s.write(op.device)
+		}
+	}
+}
+
+func (s *DeviceStore) queue(mac string, op storeOp) {
+	s.mu.Lock()
+	s.pending[mac] = op
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *DeviceStore) indexKey() string {
+	return s.prefix + "_index"
+}
+
+func (s *DeviceStore) deviceKey(mac string) string {
+	return s.prefix + "_" + mac
+}
+
+func (s *DeviceStore) Save(d comunication.Device) {
+	s.queue(d.MacAddress, storeOp{device: d})
+}
+
+func (s *DeviceStore) write(d comunication.Device) bool {
+	err := s.storage.SetFields(s.deviceKey(d.MacAddress), deviceFields(d, true))
+
+	if err != nil {
+		log.Println("[ERROR] Failed to store device", d.MacAddress, err.Error())
+
+		return false
+	}
+
+	err = s.storage.AddMember(s.indexKey(), d.MacAddress)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to index device", d.MacAddress, err.Error())
+
+		return false
+	}
+
+	return true
+}
+
+// SaveAll writes the devices copied from the monitor at copiedAt in pipelined batches, without the monitor lock.
+// The state fields are left to Save, so a transition made after the copy is not overwritten,
+// and devices deleted after the copy are skipped.
+func (s *DeviceStore) SaveAll(devices []comunication.Device, copiedAt time.Time) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.mu.Lock()
+	var kept []comunication.Device
+	for _, d := range devices {
+		if at, ok := s.deleted[d.MacAddress]; !ok || at.Before(copiedAt) {
+			kept = append(kept, d)
+		}
+	}
+	s.mu.Unlock()
+	devices = kept
+
+	for start := 0; start < len(devices); start += snapshotBatch {
+		end := start + snapshotBatch
+		if end > len(devices) {
+			end = len(devices)
+		}
+
+		hashes := make(map[string]map[string]interface{})
+		var macs []string
+
+		for _, d := range devices[start:end] {
+			hashes[s.deviceKey(d.MacAddress)] = deviceFields(d, false)
+			macs = append(macs, d.MacAddress)
+		}
+
+		err := s.storage.SetFieldsPipelined(hashes, s.indexKey(), macs)
+
+		if err != nil {
+			log.Println("[ERROR] Failed to store devices:", err.Error())
+		}
+	}
+
+	// a later snapshot copies the devices after these deletions
+	s.mu.Lock()
+	for mac, at := range s.deleted {
+		if at.Before(copiedAt) {
+			delete(s.deleted, mac)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// deviceFields encodes the hash fields, the state fields override the device when it is restored
+func deviceFields(d comunication.Device, withState bool) map[string]interface{} {
+	values := map[string]interface{}{
+		"device":   d,
+		"key":      d.Key,
+		"name":     d.Name,
+		"interval": d.Interval,
+		"lastSeen": d.LastSeen,
+	}
+
+	if withState {
+		values["line"] = d.Line
+		values["powerOnAt"] = d.PowerOnAt
+		values["powerOffAt"] = d.PowerOffAt
+		values["isPluggedIn"] = d.IsPluggedIn
+	}
+
+	fields := make(map[string]interface{})
+
+	for name, value := range values {
+		b, err := json.Marshal(value)
+
+		if err != nil {
+			log.Println("[ERROR] Failed to marshal device field", name, err.Error())
+
+			continue
+		}
+
+		fields[name] = string(b)
+	}
+
+	return fields
+}
+
+func (s *DeviceStore) Delete(mac string) {
+	s.mu.Lock()
+	s.deleted[mac] = time.Now()
+	s.mu.Unlock()
+
+	s.queue(mac, storeOp{delete: true})
+}
+
+func (s *DeviceStore) remove(mac string) {
+	if err := s.storage.Delete(s.deviceKey(mac)); err != nil {
+		log.Println("[ERROR] Failed to delete device", mac, err.Error())
+	}
+
+	if err := s.storage.RemoveMember(s.indexKey(), mac); err != nil {
+		log.Println("[ERROR] Failed to delete device", mac, err.Error())
+	}
+}
+
+// Restore loads the per device hashes. The legacy list kept under the prefix key is read only
+// while there are no hashes yet, true is returned for such devices, which need Migrate.
+func (s *DeviceStore) Restore() (map[string]comunication.Device, bool) {
+	devices := s.Load()
+
+	if len(devices) > 0 {
+		return devices, false
+	}
+
+	data, err := s.storage.Get(s.prefix)
+
+	if err != nil || data == "" {
+		return devices, false
+	}
+
+	for _, d := range DecodeDevices(data) {
+		devices[d.MacAddress] = d
+	}
+
+	return devices, len(devices) > 0
+}
+
+// Migrate writes the devices restored from the legacy list as hashes and removes the list,
+// so a device deleted later does not come back from it.
+func (s *DeviceStore) Migrate(devices map[string]comunication.Device) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	for _, d := range devices {
+		if !s.write(d) {
+			return
+		}
+	}
+
+	if err := s.storage.Delete(s.prefix); err != nil {
+		log.Println("[ERROR] Failed to remove migrated device list", s.prefix, err.Error())
+	}
+}
+
+// Load returns every device that could be recovered, devices without a complex key are skipped
+func (s *DeviceStore) Load() map[string]comunication.Device {
+	devices := make(map[string]comunication.Device)
+	macs, err := s.storage.Members(s.indexKey())
+
+	if err != nil {
+		log.Println("[ERROR] Failed to load device index:", err.Error())
+
+		return devices
+	}
+
+	for _, mac := range macs {
+		fields, err := s.storage.GetFields(s.deviceKey(mac))
+
+		if err != nil {
+			log.Println("[ERROR] Failed to load device", mac, err.Error())
+
+			continue
+		}
+
+		d, ok := decodeDeviceFields(mac, fields)
+
+		if !ok {
+			log.Println("[ERROR] Device", mac, "can not be restored")
+
+			continue
+		}
+
+		devices[mac] = d
+	}
+
+	return devices
+}
+
+func decodeDeviceFields(mac string, fields map[string]string) (comunication.Device, bool) {
+	d := comunication.Device{}
+	decode := func(name string, value interface{}) {
+		raw, ok := fields[name]
+
+		if !ok {
+			return
+		}
+
+		if err := json.Unmarshal([]byte(raw), value); err != nil {
+			log.Println("[ERROR] Failed to restore field", name, "of", mac, err.Error())
+		}
+	}
+
+	decode("device", &d)
+
+	// the state fields are written together with the device and restore the state when it is broken
+	var line comunication.Line
+	var lastSeen, powerOnAt, powerOffAt time.Time
+	var isPluggedIn *bool
+	var key, name string
+	var interval int64
+	decode("key", &key)
+	decode("name", &name)
+	decode("interval", &interval)
+	decode("line", &line)
+	decode("lastSeen", &lastSeen)
+	decode("powerOnAt", &powerOnAt)
+	decode("powerOffAt", &powerOffAt)
+	decode("isPluggedIn", &isPluggedIn)
+
+	if key != "" {
+		d.Key = key
+	}
+
+	if name != "" {
+		d.Name = name
+	}
+
+	if interval > 0 {
+		d.Interval = interval
+	}
+
+	if line.State != "" {
+		d.Line = line
+	}
+
+	if !lastSeen.IsZero() {
+		d.LastSeen = lastSeen
+	}
+
+	if !powerOnAt.IsZero() {
+		d.PowerOnAt = powerOnAt
+	}
+
+	if !powerOffAt.IsZero() {
+		d.PowerOffAt = powerOffAt
+	}
+
+	if isPluggedIn != nil {
+		d.IsPluggedIn = *isPluggedIn
+	}
+
+	d.MacAddress = mac
+
+	return d, d.Key != ""
+}
+
+// DecodeDevices reads a JSON list of devices entry by entry, a broken entry does not lose the others
+func DecodeDevices(data string) []comunication.Device {
+	var entries []json.RawMessage
+	err := json.Unmarshal([]byte(data), &entries)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to restore data from storage:", err.Error())
+
+		return nil
+	}
+
+	var devices []comunication.Device
+	for _, entry := range entries {
+		var d comunication.Device
+
+		if err := json.Unmarshal(entry, &d); err != nil || d.MacAddress == "" {
+			log.Println("[ERROR] Skipped broken device entry:", string(entry))
+
+			continue
+		}
+
+		devices = append(devices, d)
+	}
+
+	return devices
+}
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"encoding/json"
+	"go-meshtastic-monitor/comunication"
+	"log"
+	"sync"
+	"time"
+)
+
+const FollowUpsKey = "follow_ups"
+const FollowUpCheckInterval = 60
+
+type outage struct {
+	Device comunication.Device `json:"device"`
+	Since  time.Time           `json:"since"`
+	Sent   int64               `json:"sent"`
+}
+
+// FollowUps reminds about lines that stay without power longer than the complex follow_up_hours thresholds.
+type FollowUps struct {
+	rw       sync.Mutex
+	outages  map[string]outage
+	n        *Notifier
+	storage  *RedisStorage
+	stopChan chan struct{}
+}
+
+func NewFollowUps(notifier *Notifier, storage *RedisStorage) *FollowUps {
+	return &FollowUps{
+		outages:  make(map[string]outage),
+		n:        notifier,
+		storage:  storage,
+		stopChan: make(chan struct{}),
+	}
+}
+
+func (f *FollowUps) HandleTransition(t Transition) {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+
+	switch t.State {
+	case StateOff:
+		// an outage recorded by the device while offline may already be over
+		if t.Backfilled || len(t.Device.Complex.FollowUpHours) == 0 {
+			return
+		}
+
+		// the line reports off again after a period without data, the outage goes on
+		if _, ok := f.outages[t.MacAddress]; ok {
+			return
+		}
+
+		f.outages[t.MacAddress] = outage{Device: t.Device, Since: t.At}
+	case StateOn:
+		if _, ok := f.outages[t.MacAddress]; !ok {
+			return
+		}
+
+		delete(f.outages, t.MacAddress)
+	default:
+		// a device without data, e.g. with a dead battery, does not end the outage
+		return
+	}
+
+	f.persist()
+}
+
+// RemoveLine cancels the reminders of a deleted line
+func (f *FollowUps) RemoveLine(mac string) {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+
+	if _, ok := f.outages[mac]; !ok {
+		return
+	}
+
+	delete(f.outages, mac)
+	f.persist()
+}
+
+func (f *FollowUps) Restore() {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	data, err := f.storage.Get(FollowUpsKey)
+
+	if err != nil || data == "" {
+		return
+	}
+
+	var outages map[string]outage
+	err = json.Unmarshal([]byte(data), &outages)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to restore follow ups:", err.Error())
+
+		return
+	}
+
+	f.outages = outages
+}
+
+func (f *FollowUps) Start() {
+	t := time.NewTicker(time.Second * FollowUpCheckInterval)
+
+	for {
+		select {
+		case <-t.C:
+			f.check(time.Now())
+		case <-f.stopChan:
+			return
+		}
+	}
+}
+
+func (f *FollowUps) Stop() {
+	f.stopChan <- struct{}{}
+}
+
+func (f *FollowUps) check(now time.Time) {
+	// reminders are sent without the lock, HandleTransition is called under the monitor locks
+	for _, notification := range f.due(now) {
+		f.n.Notify(notification)
+	}
+}
+
+func (f *FollowUps) due(now time.Time) []Notification {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+	var notifications []Notification
+
+	removed := false
+
+	for mac, o := range f.outages {
+		// thresholds and channels are read from the current configuration, a removed complex ends the reminders
+		c, ok := f.n.findComplex(o.Device.Key)
+
+		if !ok || len(c.FollowUpHours) == 0 {
+			delete(f.outages, mac)
+			removed = true
+
+			continue
+		}
+		o.Device.Complex = c
+
+		var reached int64
+		for _, h := range c.FollowUpHours {
+			if h > o.Sent && h > reached && now.Sub(o.Since) >= time.Duration(h)*time.Hour {
+				reached = h
+			}
+		}
+
+		if reached == 0 {
+			continue
+		}
+
+		// only the largest crossed threshold is announced, e.g. after a restart in the middle of an outage
+		o.Sent = reached
+		f.outages[mac] = o
+		message := o.Device.GenerateFollowUpMessage(o.Since, now)
+
+		notifications = append(notifications, Notification{Device: o.Device, Message: message})
+
+		if len(c.FollowUpChannels) > 0 {
+			notifications = append(notifications, Notification{Device: o.Device, Message: message, Channels: c.FollowUpChannels})
+		}
+	}
+
+	if len(notifications) > 0 || removed {
+		f.persist()
+	}
+
+	return notifications
+}
+
+func (f *FollowUps) persist() {
+	b, err := json.Marshal(f.outages)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to marshal follow ups:", err.Error())
+
+		return
+	}
+
+	err = f.storage.Store(FollowUpsKey, string(b))
+
+	if err != nil {
+		log.Println("[ERROR] Failed to store follow ups:", err.Error())
+	}
+}
@@ -0,0 +1,261 @@
+package core
+
+import (
+	"encoding/json"
+	"go-meshtastic-monitor/comunication"
+	"log"
+	"sort"
+	"time"
+)
+
+const HistoryKey = "history_"
+const HistoryLimit = 5000
+const HistoryQueueSize = 1000
+
+const StateOn = string(comunication.LineOn)
+const StateOff = string(comunication.LineOff)
+const StateUnreachable = string(comunication.LineUnreachable)
+
+type Transition struct {
+	ComplexKey    string              `json:"complexKey"`
+	ComplexName   string              `json:"complexName"`
+	MacAddress    string              `json:"mac"`
+	DeviceName    string              `json:"device"`
+	State         string              `json:"state"`
+	From          string              `json:"from,omitempty"`
+	At            time.Time           `json:"at"`
+	PreviousSince time.Time           `json:"previousSince"`
+	Backfilled    bool                `json:"backfilled,omitempty"`
+	Device        comunication.Device `json:"-"`
+}
+
+type TransitionHandler interface {
+	HandleTransition(t Transition)
+}
+
+// LineRemover is a TransitionHandler keeping state of a line, which is dropped when the line is deleted
+type LineRemover interface {
+	RemoveLine(mac string)
+}
+
+// History keeps the transitions of every complex in Redis. Transitions arrive under the monitor
+// locks, so they are queued and written by the Start goroutine.
+type History struct {
+	storage  *RedisStorage
+	queue    chan Transition
+	stopChan chan struct{}
+}
+
+func NewTransition(d comunication.Device, state string, at time.Time, previousSince time.Time) Transition {
+	return Transition{
+		ComplexKey:    d.Complex.Key,
+		ComplexName:   d.Complex.Name,
+		MacAddress:    d.MacAddress,
+		DeviceName:    d.Name,
+		State:         state,
+		At:            at,
+		PreviousSince: previousSince,
+		Device:        d,
+	}
+}
+
+// PreviousDuration is how long the line stayed in the state it just left, zero when unknown.
+func (t Transition) PreviousDuration() time.Duration {
+	if t.PreviousSince.IsZero() || t.At.Before(t.PreviousSince) {
+		return 0
+	}
+
+	return t.At.Sub(t.PreviousSince)
+}
+
+// OutageDuration is how long the line stayed without power before this transition, zero when
+// the line left another state, e.g. a period without data from the device.
+func (t Transition) OutageDuration() time.Duration {
+	if t.From != StateOff {
+		return 0
+	}
+
+	return t.PreviousDuration()
+}
+
+func NewHistory(storage *RedisStorage) *History {
+	return &History{
+		storage:  storage,
+		queue:    make(chan Transition, HistoryQueueSize),
+		stopChan: make(chan struct{}),
+	}
+}
+
+func (h *History) HandleTransition(t Transition) {
+	select {
+	case h.queue <- t:
+	default:
+		log.Println("[ERROR] History queue is full, dropped transition:", t.MacAddress, t.State, t.At)
+	}
+}
+
+func (h *History) Start() {
+	for {
+		select {
+		case t := <-h.queue:
+			h.store(t)
+		case <-h.stopChan:
+			// transitions queued before the stop are still written
+			for {
+				select {
+				case t := <-h.queue:
+					h.store(t)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (h *History) Stop() {
+	h.stopChan <- struct{}{}
+}
+
+func (h *History) store(t Transition) {
+	b, err := json.Marshal(t)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to marshal transition:", err.Error())
+
+		return
+	}
+
+	err = h.storage.Push(HistoryKey+t.ComplexKey, string(b), HistoryLimit)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to store transition:", err.Error())
+	}
+}
+
+// Last returns up to n latest transitions of the complex, newest first.
+func (h *History) Last(complexKey string, n int) ([]Transition, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	// backfilled transitions are pushed after newer ones, so the latest are known only after sorting all of them
+	transitions, err := h.load(complexKey, HistoryLimit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(transitions) > n {
+		transitions = transitions[:n]
+	}
+
+	return transitions, nil
+}
+
+// Uptime sums the time every line of the complex spent with and without power between from and to.
+// Periods before the first recorded transition of a line are not counted.
+func (h *History) Uptime(complexKey string, from time.Time, to time.Time) ([]comunication.LineStat, error) {
+	transitions, err := h.load(complexKey, HistoryLimit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var order []string
+	lines := make(map[string]*lineUptime)
+
+	for i := len(transitions) - 1; i >= 0; i-- {
+		t := transitions[i]
+
+		if t.At.After(to) {
+			break
+		}
+
+		l, ok := lines[t.MacAddress]
+
+		if !ok {
+			l = &lineUptime{}
+			lines[t.MacAddress] = l
+			order = append(order, t.MacAddress)
+		}
+
+		l.stat.Name = t.DeviceName
+		l.addPeriod(from, t.At)
+		l.state = t.State
+		l.since = t.At
+	}
+
+	var stats []comunication.LineStat
+	for _, mac := range order {
+		l := lines[mac]
+		l.addPeriod(from, to)
+
+		if l.stat.TotalSecondsOnline+l.stat.TotalSecondsOffline == 0 {
+			continue
+		}
+
+		stats = append(stats, l.stat)
+	}
+
+	return stats, nil
+}
+
+type lineUptime struct {
+	stat  comunication.LineStat
+	state string
+	since time.Time
+}
+
+func (l *lineUptime) addPeriod(from time.Time, until time.Time) {
+	if l.state == "" {
+		return
+	}
+
+	since := l.since
+	if since.Before(from) {
+		since = from
+	}
+
+	if !until.After(since) {
+		return
+	}
+
+	seconds := int64(until.Sub(since).Seconds())
+
+	// time without data from the device is neither
+	switch l.state {
+	case StateOn:
+		l.stat.TotalSecondsOnline += seconds
+	case StateOff:
+		l.stat.TotalSecondsOffline += seconds
+	}
+}
+
+func (h *History) load(complexKey string, n int64) ([]Transition, error) {
+	items, err := h.storage.Range(HistoryKey+complexKey, 0, n-1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var transitions []Transition
+	for _, item := range items {
+		var t Transition
+
+		if err := json.Unmarshal([]byte(item), &t); err != nil {
+			log.Println("[ERROR] Failed to unmarshal transition:", err.Error())
+
+			continue
+		}
+
+		transitions = append(transitions, t)
+	}
+
+	// backfilled transitions are pushed after the ones they precede
+	sort.SliceStable(transitions, func(i, j int) bool {
+		return transitions[i].At.After(transitions[j].At)
+	})
+
+	return transitions, nil
+}
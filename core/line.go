@@ -0,0 +1,33 @@
+package core
+
+import (
+	"go-meshtastic-monitor/comunication"
+	"time"
+)
+
+// ApplyLine syncs the device line with the active mutes and feeds it the input.
+// Only a change of the observed state is returned.
+func (n *Notifier) ApplyLine(d *comunication.Device, input comunication.LineInput, at time.Time) (comunication.LineEvent, bool) {
+	n.SyncMute(d, at)
+
+	return d.Line.Apply(input, at)
+}
+
+// SyncMute mutes or unmutes the device line as the active mutes say, true when the line changed
+func (n *Notifier) SyncMute(d *comunication.Device, at time.Time) bool {
+	input := comunication.InputUnmute
+	if n.mutes.IsMuted(*d) {
+		input = comunication.InputMute
+	}
+
+	_, changed := d.Line.Apply(input, at)
+
+	return changed
+}
+
+func NewLineTransition(d comunication.Device, e comunication.LineEvent) Transition {
+	t := NewTransition(d, string(e.To), e.At, e.PreviousSince)
+	t.From = string(e.From)
+
+	return t
+}
@@ -1,8 +1,8 @@
 package core
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"go-meshtastic-monitor/comunication"
 	"log"
 	"strings"
@@ -13,8 +13,6 @@ import (
 const IntervalCoefficient = 3
 const StorageKey = "devices"
 
-const PeriodicCheck = 10
-
 type Event struct {
 	DeviceName  string `json:"device"`
 	DateTime    string `json:"datetime"`
@@ -26,9 +24,15 @@ type Monitor struct {
 	complexes map[string]comunication.Complex
 	devices   map[string]comunication.Device
 	n         *Notifier
-	stopChan  chan struct{}
 	rw        sync.RWMutex
 	storage   *RedisStorage
+	adaptive  AdaptiveConf
+	deadlines *Deadlines
+	c         *Correlator
+	store     *DeviceStore
+
+	// restoredAt is the server start, data older than it says nothing about the time the server was down
+	restoredAt time.Time
 
 	s *Schedule
 }
@@ -43,114 +47,236 @@ func ToMap(complexes []comunication.Complex) map[string]comunication.Complex {
 	return m
 }
 
-func NewMonitor(c []comunication.Complex, notifier *Notifier, storage *RedisStorage) *Monitor {
+func NewMonitor(c []comunication.Complex, notifier *Notifier, storage *RedisStorage, schedule *Schedule) *Monitor {
 	m := &Monitor{
 		complexes: ToMap(c),
 		devices:   make(map[string]comunication.Device),
 		n:         notifier,
-		stopChan:  make(chan struct{}),
 		storage:   storage,
+		s:         schedule,
 	}
+	m.deadlines = NewDeadlines(m.checkDevice)
+	m.c = NewCorrelator(notifier)
+	m.store = NewDeviceStore(storage, StorageKey)
 
 	return m
 }
 
+// Restore reads the per device hashes written on every transition, the snapshot list of older versions is migrated.
 func (m *Monitor) Restore() {
 	m.rw.Lock()
 	defer m.rw.Unlock()
-	data, err := m.storage.Get(StorageKey)
+	devices, legacy := m.store.Restore()
 
-	if err != nil {
-		log.Println("[ERROR] Failed to restore data from storage:", err.Error())
+	for mac, device := range devices {
+		if device.Line.State != "" {
+			continue
+		}
 
-		return
+		if device.IsTimeout() {
+			device.Line = comunication.RestoredLine(comunication.LineOff, device.LastSeen)
+		} else {
+			device.Line = comunication.RestoredLine(comunication.LineOn, device.PowerOnAt)
+		}
+		devices[mac] = device
 	}
 
-	if data == "" {
-		log.Println("[ERROR] Failed to restore data from storage. Data is empty.")
-
+	if len(devices) == 0 {
 		return
 	}
-	var devices []comunication.Device
-	err = json.Unmarshal([]byte(data), &devices)
 
-	if err != nil {
-		log.Println("[ERROR] Failed to restore data from storage:", err.Error())
-
-		return
+	if legacy {
+		m.store.Migrate(devices)
 	}
 
-	m.devices = m.toMap(devices)
+	m.devices = devices
+	m.restoredAt = time.Now()
+}
+
+// Snapshot writes every device to its hash, transitions are written as they happen.
+// The devices are copied under the lock and written without it.
+func (m *Monitor) Snapshot() {
+	m.rw.RLock()
+	devices := m.fromMap(m.devices)
+	copiedAt := time.Now()
+	m.rw.RUnlock()
+
+	m.store.SaveAll(devices, copiedAt)
 }
 
 func (m *Monitor) Backup() {
+	// transitions queued before the stop are written first
+	m.store.Flush()
+
 	m.rw.RLock()
-	defer m.rw.RUnlock()
+	devices := m.fromMap(m.devices)
+	copiedAt := time.Now()
+	m.rw.RUnlock()
 
-	if len(m.devices) == 0 {
+	if len(devices) == 0 {
 		log.Println("[INFO] No devices to backup")
 		return
 	}
 
-	b, err := json.Marshal(m.fromMap(m.devices))
+	m.store.SaveAll(devices, copiedAt)
 
-	if err != nil {
-		log.Println("Error marshalling devices:", err.Error())
+	log.Println("[INFO] Backup complete")
+}
+
+// Start checks every device once and then wakes up exactly at the timeout of each device.
+func (m *Monitor) Start() {
+	go m.store.Start()
+	m.CheckDevice()
+	m.deadlines.Start()
+}
+
+func (m *Monitor) CheckDevice() {
+	m.rw.RLock()
+	var macs []string
+	for mac := range m.devices {
+		macs = append(macs, mac)
+	}
+	m.rw.RUnlock()
+
+	for _, mac := range macs {
+		m.checkDevice(mac, time.Now())
+	}
+}
+
+func (m *Monitor) checkDevice(mac string, _ time.Time) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	device, ok := m.devices[mac]
 
+	if !ok {
 		return
 	}
 
-	err = m.storage.Store(StorageKey, string(b))
-	if err != nil {
-		log.Println("Error storing devices:", err.Error())
+	// policies may change with the configuration, so the timeout is refreshed before the check
+	if c, ok := m.complexes[device.Key]; ok {
+		device.Complex = c
+		device.Timeout = m.timeout(device)
+		m.devices[device.MacAddress] = device
+	}
+
+	if !device.IsTimeout() {
+		m.deadlines.Schedule(mac, device.TimeoutAt())
 
 		return
 	}
 
-	log.Println("[INFO] Backup complete")
-}
+	now := time.Now()
 
-func (m *Monitor) Start() {
-	t := time.NewTicker(time.Second * PeriodicCheck)
+	// after a restart every device gets its own timeout to check in before it is reported
+	if device.LastSeen.Before(m.restoredAt) && device.Line.Observed == comunication.LineOn {
+		graceUntil := m.restoredAt.Add(time.Duration(device.Timeout) * time.Second)
+
+		if now.Before(graceUntil) {
+			m.deadlines.Schedule(mac, graceUntil)
 
-	for {
-		select {
-		case <-t.C:
-			m.CheckDevice()
-		case <-m.stopChan:
 			return
 		}
+
+		event, _ := m.n.ApplyLine(&device, comunication.InputPowerOff, m.restoredAt)
+		device.PowerOffAt = m.restoredAt
+		device.IsPluggedIn = false
+		m.devices[mac] = device
+
+		m.n.Transition(NewLineTransition(device, event))
+		m.store.Save(device)
+		if event.ShouldNotify() {
+			m.n.Notify(Notification{
+				Device:  device,
+				Message: device.GenerateDowntimeOffMessage(m.restoredAt),
+			})
+		}
+
+		return
 	}
-}
 
-func (m *Monitor) CheckDevice() {
-	m.rw.Lock()
-	defer m.rw.Unlock()
-	for _, device := range m.devices {
-		if device.IsTimeout() {
-			if !device.DownNotificationSend {
-				device.DownNotificationSend = true
-				device.UpNotificationSend = false
+	if device.Line.Observed == comunication.LineUnreachable {
+		// after a restart the line gets its own timeout to report before the window starts
+		since := device.Line.ObservedSince
+		if device.LastSeen.Before(m.restoredAt) {
+			since = m.restoredAt.Add(time.Duration(device.Timeout) * time.Second)
+		}
 
-				m.devices[device.MacAddress] = device
+		off, next := m.c.Reconcile(mac, since, now)
 
-				m.n.Notify(Notification{
-					Device:  device,
-					Message: device.GeneratePowerOffMessage(),
-				})
-			}
+		if !next.IsZero() {
+			m.deadlines.Schedule(mac, next)
+		}
+
+		if !off {
+			return
+		}
+	} else if device.Line.Observed == comunication.LineOn {
+		if until, hold := m.c.Hold(mac, now); hold {
+			m.deadlines.Schedule(mac, until)
+
+			return
 		}
+
+		if m.c.Correlated(device, m.devices, now) {
+			event, _ := m.n.ApplyLine(&device, comunication.InputLost, device.LastSeen)
+			m.devices[mac] = device
+			m.n.Transition(NewLineTransition(device, event))
+			m.store.Save(device)
+
+			return
+		}
+	}
+
+	event, changed := m.n.ApplyLine(&device, comunication.InputPowerOff, device.LastSeen)
+
+	if !changed {
+		return
+	}
+
+	device.PowerOffAt = device.LastSeen
+	device.IsPluggedIn = false
+	m.devices[device.MacAddress] = device
+
+	m.n.Transition(NewLineTransition(device, event))
+	m.store.Save(device)
+	if event.ShouldNotify() {
+		m.n.Notify(Notification{
+			Device:  device,
+			Message: device.GeneratePowerOffMessage(),
+		})
 	}
 }
 
 func (m *Monitor) Stop() {
-	m.stopChan <- struct{}{}
+	m.deadlines.Stop()
+	m.store.Stop()
+}
+
+// SyncMutes applies a mute change to the lines at once instead of waiting for their next input
+func (m *Monitor) SyncMutes() {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	now := time.Now()
+
+	for mac, device := range m.devices {
+		if !m.n.SyncMute(&device, now) {
+			continue
+		}
+
+		m.devices[mac] = device
+		m.store.Save(device)
+	}
 }
 
 func (m *Monitor) UpdateComplexes(complexes []comunication.Complex) {
 	m.rw.Lock()
 	defer m.rw.Unlock()
 	m.complexes = ToMap(complexes)
+
+	// timeouts depend on the complex policy, every device is checked again with the new one
+	for mac := range m.devices {
+		m.deadlines.Schedule(mac, time.Now())
+	}
 }
 
 func (m *Monitor) AddDevice(d comunication.Device) {
@@ -162,40 +288,111 @@ func (m *Monitor) AddDevice(d comunication.Device) {
 	if err != nil {
 		if exist {
 			delete(m.devices, d.MacAddress)
+			m.store.Delete(d.MacAddress)
+			m.n.RemoveLine(d.MacAddress)
+			m.deadlines.Cancel(d.MacAddress)
 		}
 
+		m.n.Alert(comunication.Complex{}, "unknown_key:"+d.MacAddress, fmt.Sprintf("Пристрій \"%s\" (%s) надсилає дані з невідомим ключем комплексу \"%s\"", d.Name, d.MacAddress, d.Key))
+
 		return
 	}
 	d.Complex = c
 
+	now := time.Now()
+
 	if exist {
 		device := m.devices[d.MacAddress]
+		device.Complex = c
 
-		if device.IsTimeout() {
-			if !device.UpNotificationSend {
-				device.UpNotificationSend = true
-				device.DownNotificationSend = false
+		// a held line reported in time, the hold ends without a transition
+		m.c.Seen(d.MacAddress)
+		resumed := false
+		transitioned := false
+
+		if device.Line.Observed == comunication.LineUnreachable {
+			var left []string
+			var at time.Time
+			resumed, left, at = m.c.Resumed(d.MacAddress, now)
+
+			for _, mac := range left {
+				m.deadlines.Schedule(mac, at)
+			}
+		}
 
-				device.PowerOnAt = time.Now()
+		// a line still on was held by the correlator or in its restart grace, it never went off.
+		// A gap over the server downtime is unknown, not an outage.
+		downtime := device.LastSeen.Before(m.restoredAt)
 
+		event, changed := m.n.ApplyLine(&device, comunication.InputPowerOn, now)
+
+		if changed {
+			transitioned = true
+			device.IsPluggedIn = true
+			message := device.GeneratePowerOnMessage()
+			if event.From == comunication.LineUnreachable {
+				message = device.GenerateMonitoringRestoredMessage()
+			}
+			if downtime && event.From == comunication.LineOff {
+				message += ". Точний час появи невідомий через простій сервера"
+			}
+
+			device.PowerOnAt = now
+			m.n.Transition(NewLineTransition(device, event))
+
+			// lines of a mass silence resume with one message per complex
+			if event.ShouldNotify() && !resumed {
 				m.n.Notify(Notification{
-					Device:  m.devices[d.MacAddress],
-					Message: m.devices[d.MacAddress].GeneratePowerOnMessage(),
+					Device:  device,
+					Message: message,
 				})
 			}
 		}
 
-		device.LastSeen = time.Now()
-		device.Timeout = device.Interval * IntervalCoefficient
-		device.Complex = c
+		m.recordArrival(&device, now)
+		device.LastSeen = now
+		device.Timeout = m.timeout(device)
+		if d.Telemetry != nil {
+			device.Telemetry = d.Telemetry
+		}
 		m.devices[d.MacAddress] = device
+		m.deadlines.Schedule(d.MacAddress, device.TimeoutAt())
+
+		if transitioned {
+			m.store.Save(device)
+		}
 	} else {
-		d.LastSeen = time.Now()
-		d.PowerOnAt = time.Now()
-		d.Timeout = d.Interval * IntervalCoefficient
+		d.LastSeen = now
+		d.PowerOnAt = now
+		d.IsPluggedIn = true
+		d.Arrivals = comunication.ArrivalStats{}
+		d.Line = comunication.NewLine()
+		d.Timeout = m.timeout(d)
+		event, _ := m.n.ApplyLine(&d, comunication.InputPowerOn, now)
 
 		m.devices[d.MacAddress] = d
+		m.deadlines.Schedule(d.MacAddress, d.TimeoutAt())
+		m.n.Transition(NewLineTransition(d, event))
+		m.store.Save(d)
+	}
+}
+
+// Backfill applies events the device recorded offline, false when the device is not known
+func (m *Monitor) Backfill(key string, mac string, events []comunication.DeviceEvent) bool {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	device, ok := m.devices[mac]
+
+	// the complex key is the only credential, another complex must not rewrite the history
+	if !ok || device.Key != key {
+		return false
 	}
+
+	m.n.Backfill(&device, events, time.Now())
+	m.devices[mac] = device
+	m.store.Save(device)
+
+	return true
 }
 
 func (m *Monitor) findComplex(k string) (comunication.Complex, error) {
@@ -207,6 +404,9 @@ func (m *Monitor) findComplex(k string) (comunication.Complex, error) {
 }
 
 func (m *Monitor) GetStatus() []comunication.ComplexInfo {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
 	var complexes []comunication.ComplexInfo
 	for _, complexRegistered := range m.complexes {
 		c := comunication.ComplexInfo{
@@ -229,10 +429,17 @@ func (m *Monitor) GetStatus() []comunication.ComplexInfo {
 
 			dInfo := comunication.DeviceInfo{
 				Name:              device.Name,
+				State:             device.Line.State,
 				UpdateInterval:    device.Interval,
 				CalculatedTimeout: device.Timeout,
+				LearnedTimeout:    m.learnedTimeout(device),
+				MeanInterval:      device.Arrivals.Mean(),
+				Jitter:            device.Arrivals.Jitter(),
+				MaxGap:            device.Arrivals.Max(),
+				Samples:           device.Arrivals.Count(),
 				IsOnline:          device.IsTimeout() == false,
 				LastSeen:          device.LastSeen,
+				Telemetry:         device.Telemetry,
 			}
 
 			c.Devices = append(c.Devices, dInfo)
@@ -244,7 +451,32 @@ func (m *Monitor) GetStatus() []comunication.ComplexInfo {
 	return complexes
 }
 
+func (m *Monitor) GetDevices(c comunication.Complex) []comunication.Device {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	var devices []comunication.Device
+	for _, device := range m.devices {
+		if device.Key == c.Key {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices
+}
+
+func (m *Monitor) FindDevice(mac string) (comunication.Device, bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+	device, ok := m.devices[mac]
+
+	return device, ok
+}
+
 func (m *Monitor) GetStatusText(c comunication.Complex) string {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
 	var msgs []string
 	for _, device := range m.devices {
 		if device.Key == c.Key {
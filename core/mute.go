@@ -0,0 +1,292 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"go-meshtastic-monitor/comunication"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MutesKey = "mutes"
+const MuteCheckInterval = 30
+
+type Mute struct {
+	Target     string    `json:"target"`
+	Name       string    `json:"name"`
+	ComplexKey string    `json:"complexKey"`
+	IsComplex  bool      `json:"isComplex"`
+	Until      time.Time `json:"until"`
+}
+
+type mutesBackup struct {
+	Lines     map[string]Mute `json:"lines"`
+	Complexes map[string]Mute `json:"complexes"`
+}
+
+type Mutes struct {
+	rw        sync.RWMutex
+	lines     map[string]Mute
+	complexes map[string]Mute
+	storage   *RedisStorage
+	onExpire  func(m Mute)
+	onChange  []func()
+	stopChan  chan struct{}
+}
+
+func NewMutes(storage *RedisStorage) *Mutes {
+	return &Mutes{
+		lines:     make(map[string]Mute),
+		complexes: make(map[string]Mute),
+		storage:   storage,
+		stopChan:  make(chan struct{}),
+	}
+}
+
+// ParseMuteUntil accepts a duration ("90m", "2h"), a time of day ("18:30", next occurrence),
+// a date with time ("2006-01-02 15:04") or RFC3339, which must be in the future. Empty value means until unmuted.
+func ParseMuteUntil(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		if d <= 0 {
+			return time.Time{}, errors.New("duration must be positive")
+		}
+
+		return now.Add(d), nil
+	}
+
+	if t, err := time.ParseInLocation("15:04", value, now.Location()); err == nil {
+		until := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+
+		if !until.After(now) {
+			until = until.AddDate(0, 0, 1)
+		}
+
+		return until, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02 15:04", value, now.Location()); err == nil {
+		return mutedUntil(t, now)
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return mutedUntil(t, now)
+	}
+
+	return time.Time{}, errors.New("unknown mute period " + value)
+}
+
+func mutedUntil(until time.Time, now time.Time) (time.Time, error) {
+	if !until.After(now) {
+		return time.Time{}, errors.New("mute end is in the past")
+	}
+
+	return until, nil
+}
+
+func (m *Mutes) SetExpireHandler(handler func(m Mute)) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	m.onExpire = handler
+}
+
+// AddChangeHandler is called after every mute change, including expiry, so the lines follow it at once
+func (m *Mutes) AddChangeHandler(handler func()) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	m.onChange = append(m.onChange, handler)
+}
+
+func (m *Mutes) changed() {
+	m.rw.RLock()
+	handlers := m.onChange
+	m.rw.RUnlock()
+
+	for _, handler := range handlers {
+		handler()
+	}
+}
+
+func (m *Mutes) Restore() {
+	defer m.changed()
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	data, err := m.storage.Get(MutesKey)
+
+	if err != nil || data == "" {
+		return
+	}
+
+	var backup mutesBackup
+	err = json.Unmarshal([]byte(data), &backup)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to restore mutes:", err.Error())
+
+		return
+	}
+
+	if backup.Lines != nil {
+		m.lines = backup.Lines
+	}
+
+	if backup.Complexes != nil {
+		m.complexes = backup.Complexes
+	}
+}
+
+func (m *Mutes) Start() {
+	t := time.NewTicker(time.Second * MuteCheckInterval)
+
+	for {
+		select {
+		case <-t.C:
+			m.expire(time.Now())
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+func (m *Mutes) Stop() {
+	m.stopChan <- struct{}{}
+}
+
+// MuteLine silences a line until the given time, zero time means until unmuted.
+func (m *Mutes) MuteLine(d comunication.Device, until time.Time) {
+	defer m.changed()
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	m.lines[d.MacAddress] = Mute{
+		Target:     d.MacAddress,
+		Name:       d.Name,
+		ComplexKey: d.Complex.Key,
+		Until:      until,
+	}
+	m.persist()
+}
+
+func (m *Mutes) UnmuteLine(mac string) {
+	defer m.changed()
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	delete(m.lines, mac)
+	m.persist()
+}
+
+// MuteComplex silences every line of a complex until the given time, zero time means until unmuted.
+func (m *Mutes) MuteComplex(c comunication.Complex, until time.Time) {
+	defer m.changed()
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	m.complexes[c.Key] = Mute{
+		Target:     c.Key,
+		Name:       c.Name,
+		ComplexKey: c.Key,
+		IsComplex:  true,
+		Until:      until,
+	}
+	m.persist()
+}
+
+func (m *Mutes) UnmuteComplex(key string) {
+	defer m.changed()
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	delete(m.complexes, key)
+	m.persist()
+}
+
+func (m *Mutes) IsMuted(d comunication.Device) bool {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	return isActive(m.lines, d.MacAddress) || isActive(m.complexes, d.Complex.Key)
+}
+
+func (m *Mutes) List() []Mute {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	var mutes []Mute
+	for _, mute := range m.complexes {
+		mutes = append(mutes, mute)
+	}
+	for _, mute := range m.lines {
+		mutes = append(mutes, mute)
+	}
+
+	return mutes
+}
+
+func (m *Mutes) expire(now time.Time) {
+	m.rw.Lock()
+	var expired []Mute
+
+	for key, mute := range m.lines {
+		if !mute.Until.IsZero() && !now.Before(mute.Until) {
+			expired = append(expired, mute)
+			delete(m.lines, key)
+		}
+	}
+
+	for key, mute := range m.complexes {
+		if !mute.Until.IsZero() && !now.Before(mute.Until) {
+			expired = append(expired, mute)
+			delete(m.complexes, key)
+		}
+	}
+
+	if len(expired) > 0 {
+		m.persist()
+	}
+
+	handler := m.onExpire
+	m.rw.Unlock()
+
+	for _, mute := range expired {
+		log.Println("[INFO] Mute expired:", mute.Target)
+
+		if handler != nil {
+			handler(mute)
+		}
+	}
+
+	// the lines of the expired mutes return to their observed state
+	if len(expired) > 0 {
+		m.changed()
+	}
+}
+
+func (m *Mutes) persist() {
+	b, err := json.Marshal(mutesBackup{Lines: m.lines, Complexes: m.complexes})
+
+	if err != nil {
+		log.Println("[ERROR] Failed to marshal mutes:", err.Error())
+
+		return
+	}
+
+	err = m.storage.Store(MutesKey, string(b))
+
+	if err != nil {
+		log.Println("[ERROR] Failed to store mutes:", err.Error())
+	}
+}
+
+func isActive(mutes map[string]Mute, key string) bool {
+	mute, ok := mutes[key]
+
+	if !ok {
+		return false
+	}
+
+	return mute.Until.IsZero() || time.Now().Before(mute.Until)
+}
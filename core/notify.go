@@ -1,48 +1,401 @@
 package core
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"go-meshtastic-monitor/comunication"
+	"log"
+	"reflect"
+	"sync"
+	"time"
 )
 
+const WebhookSecretKey = "webhook_secret_"
+const AlertRepeatInterval = 15 * time.Minute
+const ModeWebhook = "webhook"
+const ModePolling = "polling"
+
 type Notification struct {
 	Device  comunication.Device
 	Message string
+	// Channels replaces the complex bot_channels when set
+	Channels []int64
+}
+
+// OperatorConf describes the deployment wide chat for infrastructure problems residents must not see
+type OperatorConf struct {
+	BotToken string  `json:"bot_token" yaml:"bot_token"`
+	Channels []int64 `json:"channels" yaml:"channels"`
+}
+
+type alert struct {
+	Complex comunication.Complex
+	Message string
+}
+
+type UpdateHandler func(c comunication.Complex, bot *tgbotapi.BotAPI, u tgbotapi.Update)
+
+type BotRegistration struct {
+	Identity           string    `json:"identity"`
+	ComplexName        string    `json:"complexName"`
+	Mode               string    `json:"mode"`
+	WebhookUrl         string    `json:"webhookUrl,omitempty"`
+	WebhookChanged     bool      `json:"webhookChanged"`
+	PendingUpdates     int       `json:"pendingUpdates"`
+	LastWebhookError   string    `json:"lastWebhookError,omitempty"`
+	CommandsRegistered bool      `json:"commandsRegistered"`
+	Error              string    `json:"error,omitempty"`
+	CheckedAt          time.Time `json:"checkedAt"`
 }
 
 type Notifier struct {
 	notifications  chan Notification
 	c              chan struct{}
 	webhookPattern string
+	storage        *RedisStorage
+	mutes          *Mutes
+	operator       OperatorConf
+	alerts         chan alert
+
+	alertLock sync.Mutex
+	alertedAt map[string]time.Time
+	prunedAt  time.Time
+
+	// initLock serializes InitBots, which talks to Telegram without holding rw
+	initLock sync.Mutex
+
+	rw            sync.RWMutex
+	complexes     map[string]comunication.Complex
+	byKey         map[string]comunication.Complex
+	pollers       map[string]*tgbotapi.BotAPI
+	handler       UpdateHandler
+	commands      []tgbotapi.BotCommand
+	registrations map[string]BotRegistration
+	handlers      []TransitionHandler
+}
+
+func NewNotifier(webhookPattern string, operator OperatorConf, storage *RedisStorage) *Notifier {
+	n := &Notifier{
+		notifications:  make(chan Notification, 100),
+		c:              make(chan struct{}),
+		webhookPattern: webhookPattern,
+		storage:        storage,
+		mutes:          NewMutes(storage),
+		operator:       operator,
+		alerts:         make(chan alert, 100),
+		alertedAt:      make(map[string]time.Time),
+		complexes:      make(map[string]comunication.Complex),
+		byKey:          make(map[string]comunication.Complex),
+		pollers:        make(map[string]*tgbotapi.BotAPI),
+		registrations:  make(map[string]BotRegistration),
+	}
+	n.mutes.SetExpireHandler(n.muteExpired)
+
+	return n
+}
+
+func (n *Notifier) Mutes() *Mutes {
+	return n.mutes
+}
+
+func (n *Notifier) muteExpired(mute Mute) {
+	complexStruct, ok := n.findComplex(mute.ComplexKey)
+
+	if !ok || !complexStruct.MuteExpiredNotice {
+		return
+	}
+
+	message := fmt.Sprintf("Сповіщення для \"%s\" знову увімкнено", mute.Name)
+	if mute.IsComplex {
+		message = fmt.Sprintf("Сповіщення комплексу \"%s\" знову увімкнено", mute.Name)
+	}
+
+	n.Notify(Notification{
+		Device:  comunication.Device{Key: complexStruct.Key, Complex: complexStruct},
+		Message: message,
+	})
+}
+
+// findComplex returns the current configuration of the complex
+func (n *Notifier) findComplex(key string) (comunication.Complex, bool) {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+	c, ok := n.byKey[key]
+
+	return c, ok
 }
 
-func NewNotifier(webhookPattern string) *Notifier {
-	return &Notifier{notifications: make(chan Notification, 100), c: make(chan struct{}), webhookPattern: webhookPattern}
+func (n *Notifier) SetCommands(commands []tgbotapi.BotCommand) {
+	n.rw.Lock()
+	defer n.rw.Unlock()
+	n.commands = commands
+}
+
+func (n *Notifier) GetRegistrations() []BotRegistration {
+	n.rw.RLock()
+	defer n.rw.RUnlock()
+
+	var registrations []BotRegistration
+	for _, r := range n.registrations {
+		registrations = append(registrations, r)
+	}
+
+	return registrations
+}
+
+func (n *Notifier) AddTransitionHandler(handler TransitionHandler) {
+	n.rw.Lock()
+	defer n.rw.Unlock()
+	n.handlers = append(n.handlers, handler)
+}
+
+// RemoveLine tells the handlers keeping per line state that the line was deleted
+func (n *Notifier) RemoveLine(mac string) {
+	n.rw.RLock()
+	handlers := n.handlers
+	n.rw.RUnlock()
+
+	for _, handler := range handlers {
+		if remover, ok := handler.(LineRemover); ok {
+			remover.RemoveLine(mac)
+		}
+	}
+}
+
+// Transition passes a line state change to every registered handler, regardless of notification settings.
+func (n *Notifier) Transition(t Transition) {
+	n.rw.RLock()
+	handlers := n.handlers
+	n.rw.RUnlock()
+
+	for _, handler := range handlers {
+		handler.HandleTransition(t)
+	}
+}
+
+func (n *Notifier) SetUpdateHandler(handler UpdateHandler) {
+	n.rw.Lock()
+	defer n.rw.Unlock()
+	n.handler = handler
 }
 
 func (n *Notifier) InitBots(complexes []comunication.Complex) {
+	n.initLock.Lock()
+	defer n.initLock.Unlock()
+
+	byIdentity := make(map[string]comunication.Complex)
+	byKey := make(map[string]comunication.Complex)
 	for _, complexStruct := range complexes {
-		bot, err := tgbotapi.NewBotAPI(complexStruct.BotToken)
+		byIdentity[complexStruct.BotIdentity] = complexStruct
+		byKey[complexStruct.Key] = complexStruct
+	}
 
-		if err != nil {
-			continue
+	n.rw.Lock()
+	n.complexes = byIdentity
+	n.byKey = byKey
+	commands := n.commands
+	pollers := make(map[string]*tgbotapi.BotAPI)
+	for identity, bot := range n.pollers {
+		pollers[identity] = bot
+	}
+	n.rw.Unlock()
+
+	// Telegram and Redis are called without the lock, the monitors notify while holding their own locks
+	registrations := make(map[string]BotRegistration)
+
+	for _, complexStruct := range complexes {
+		r := n.register(complexStruct, pollers, commands)
+
+		if r.Error != "" {
+			log.Println("[ERROR] Bot registration failed:", r.Identity, r.Error)
+			n.Alert(complexStruct, "bot_registration:"+r.Identity, fmt.Sprintf("Не вдалося зареєструвати бота %s: %s", r.Identity, r.Error))
 		}
 
-		webhookUrl := fmt.Sprintf(n.webhookPattern, complexStruct.BotIdentity)
+		registrations[complexStruct.BotIdentity] = r
+	}
 
-		wh, err := tgbotapi.NewWebhook(webhookUrl)
+	for identity := range pollers {
+		if c, ok := byIdentity[identity]; !ok || !c.UsePolling {
+			stopPolling(pollers, identity)
+		}
+	}
 
-		if err != nil {
-			continue
+	n.rw.Lock()
+	n.pollers = pollers
+	n.registrations = registrations
+	n.rw.Unlock()
+}
+
+func (n *Notifier) register(c comunication.Complex, pollers map[string]*tgbotapi.BotAPI, commands []tgbotapi.BotCommand) BotRegistration {
+	r := BotRegistration{
+		Identity:    c.BotIdentity,
+		ComplexName: c.Name,
+		Mode:        ModeWebhook,
+		CheckedAt:   time.Now(),
+	}
+
+	if c.UsePolling {
+		r.Mode = ModePolling
+	} else {
+		stopPolling(pollers, c.BotIdentity)
+	}
+
+	bot, err := tgbotapi.NewBotAPI(c.BotToken)
+
+	if err != nil {
+		r.Error = "bot init: " + err.Error()
+
+		return r
+	}
+
+	info, err := bot.GetWebhookInfo()
+
+	if err != nil {
+		r.Error = "get webhook info: " + err.Error()
+
+		return r
+	}
+
+	r.PendingUpdates = info.PendingUpdateCount
+	r.LastWebhookError = info.LastErrorMessage
+
+	if c.UsePolling {
+		if info.URL != "" {
+			_, err = bot.Request(tgbotapi.DeleteWebhookConfig{})
+
+			if err != nil {
+				r.Error = "delete webhook: " + err.Error()
+
+				return r
+			}
+
+			r.WebhookChanged = true
 		}
 
-		_, err = bot.Request(wh)
+		n.startPolling(pollers, c)
+	} else {
+		r.WebhookUrl = fmt.Sprintf(n.webhookPattern, c.BotIdentity)
+		secretHash := hashSecret(c.SecretToken())
 
-		if err != nil {
-			continue
+		if info.URL != r.WebhookUrl || n.storedSecretHash(c.BotIdentity) != secretHash {
+			_, err = bot.MakeRequest("setWebhook", tgbotapi.Params{
+				"url":          r.WebhookUrl,
+				"secret_token": c.SecretToken(),
+			})
+
+			if err != nil {
+				r.Error = "set webhook: " + err.Error()
+
+				return r
+			}
+
+			r.WebhookChanged = true
+
+			err = n.storage.Store(WebhookSecretKey+c.BotIdentity, secretHash)
+
+			if err != nil {
+				log.Println("[ERROR] Failed to store webhook secret hash:", c.BotIdentity, err.Error())
+			}
 		}
 	}
+
+	err = registerCommands(bot, commands)
+
+	if err != nil {
+		r.Error = "set commands: " + err.Error()
+
+		return r
+	}
+
+	r.CommandsRegistered = true
+
+	return r
+}
+
+func registerCommands(bot *tgbotapi.BotAPI, commands []tgbotapi.BotCommand) error {
+	if len(commands) == 0 {
+		return nil
+	}
+
+	current, err := bot.GetMyCommands()
+
+	if err == nil && reflect.DeepEqual(current, commands) {
+		return nil
+	}
+
+	_, err = bot.Request(tgbotapi.NewSetMyCommands(commands...))
+
+	return err
+}
+
+func (n *Notifier) storedSecretHash(identity string) string {
+	hash, err := n.storage.Get(WebhookSecretKey + identity)
+
+	if err != nil {
+		return ""
+	}
+
+	return hash
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func (n *Notifier) startPolling(pollers map[string]*tgbotapi.BotAPI, c comunication.Complex) {
+	if bot, ok := pollers[c.BotIdentity]; ok {
+		if bot.Token == c.BotToken {
+			return
+		}
+
+		stopPolling(pollers, c.BotIdentity)
+	}
+
+	bot, err := tgbotapi.NewBotAPI(c.BotToken)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to init bot for polling:", c.BotIdentity, err.Error())
+
+		return
+	}
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	updates := bot.GetUpdatesChan(u)
+	pollers[c.BotIdentity] = bot
+
+	go func(identity string) {
+		for update := range updates {
+			n.rw.RLock()
+			complexStruct, ok := n.complexes[identity]
+			handler := n.handler
+			n.rw.RUnlock()
+
+			if !ok || handler == nil {
+				continue
+			}
+
+			handler(complexStruct, bot, update)
+		}
+	}(c.BotIdentity)
+
+	log.Println("[INFO] Started long polling for", c.BotIdentity)
+}
+
+func stopPolling(pollers map[string]*tgbotapi.BotAPI, identity string) {
+	bot, ok := pollers[identity]
+
+	if !ok {
+		return
+	}
+
+	bot.StopReceivingUpdates()
+	delete(pollers, identity)
+
+	log.Println("[INFO] Stopped long polling for", identity)
 }
 
 func (n *Notifier) Notify(notification Notification) {
@@ -58,6 +411,8 @@ func (n *Notifier) Start() {
 			return
 		case notification := <-n.notifications:
 			n.Send(notification)
+		case a := <-n.alerts:
+			n.sendAlert(a)
 		}
 	}
 }
@@ -71,20 +426,114 @@ func (n *Notifier) Send(notification Notification) {
 		return
 	}
 
+	if n.mutes.IsMuted(notification.Device) {
+		return
+	}
+
 	token := notification.Device.Complex.BotToken
 	bot, err := tgbotapi.NewBotAPI(token)
 
 	if err != nil {
+		n.Alert(notification.Device.Complex, "send_failed", fmt.Sprintf("Не вдалося надіслати сповіщення \"%s\": %s", notification.Message, err.Error()))
+
 		return
 	}
 
-	for _, channel := range notification.Device.Complex.BotChannels {
+	channels := notification.Device.Complex.BotChannels
+	if notification.Channels != nil {
+		channels = notification.Channels
+	}
+
+	for _, channel := range channels {
 		msg := tgbotapi.NewMessage(channel, notification.Message)
 		fmt.Printf("Sending message '%s' to %d\n", notification.Message, channel)
-		_, _ = bot.Send(msg)
+		_, err = bot.Send(msg)
+
+		if err != nil {
+			n.Alert(notification.Device.Complex, fmt.Sprintf("send_failed:%d", channel), fmt.Sprintf("Не вдалося надіслати сповіщення в %d: %s", channel, err.Error()))
+		}
+	}
+}
+
+// Alert reports an infrastructure problem to the complex operator_channels and the global operator chat.
+// key names the problem (its kind and the device, target or bot), alerts with the same key are
+// suppressed for AlertRepeatInterval whatever their message. Alerts never block the caller.
+func (n *Notifier) Alert(c comunication.Complex, key string, message string) {
+	log.Println("[ALERT]", c.Key, message)
+
+	if !n.shouldAlert(c.Key+"|"+key, time.Now()) {
+		return
+	}
+
+	select {
+	case n.alerts <- alert{Complex: c, Message: message}:
+	default:
+		log.Println("[ERROR] Alert queue is full, dropped:", message)
+	}
+}
+
+func (n *Notifier) shouldAlert(key string, now time.Time) bool {
+	n.alertLock.Lock()
+	defer n.alertLock.Unlock()
+
+	if now.Sub(n.prunedAt) >= AlertRepeatInterval {
+		for k, at := range n.alertedAt {
+			if now.Sub(at) >= AlertRepeatInterval {
+				delete(n.alertedAt, k)
+			}
+		}
+
+		n.prunedAt = now
+	}
+
+	if at, ok := n.alertedAt[key]; ok && now.Sub(at) < AlertRepeatInterval {
+		return false
+	}
+
+	n.alertedAt[key] = now
+
+	return true
+}
+
+func (n *Notifier) sendAlert(a alert) {
+	message := "⚠️ " + a.Message
+	if a.Complex.Name != "" {
+		message = fmt.Sprintf("⚠️ [%s] %s", a.Complex.Name, a.Message)
+	}
+
+	if a.Complex.BotToken != "" && len(a.Complex.OperatorChannels) > 0 {
+		sendToChannels(a.Complex.BotToken, a.Complex.OperatorChannels, message)
+	}
+
+	if n.operator.BotToken != "" && len(n.operator.Channels) > 0 {
+		sendToChannels(n.operator.BotToken, n.operator.Channels, message)
+	}
+}
+
+func sendToChannels(token string, channels []int64, message string) {
+	bot, err := tgbotapi.NewBotAPI(token)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to init operator bot:", err.Error())
+
+		return
+	}
+
+	for _, channel := range channels {
+		_, err = bot.Send(tgbotapi.NewMessage(channel, message))
+
+		if err != nil {
+			log.Println("[ERROR] Failed to send operator alert:", channel, err.Error())
+		}
 	}
 }
 
 func (n *Notifier) Stop() {
+	n.rw.Lock()
+	for identity := range n.pollers {
+		stopPolling(n.pollers, identity)
+	}
+	n.rw.Unlock()
+
 	n.c <- struct{}{}
 }
@@ -7,12 +7,16 @@ import (
 	"time"
 )
 
+// ReconnectAlertEvery limits reconnect alerts to one per this many failed attempts (one second each)
+const ReconnectAlertEvery = 60
+
 type (
 	RedisConnect struct {
 		lock       sync.Mutex
 		cli        *redis.Client
 		conf       RedisConf
 		errChannel chan error
+		onError    func(key string, message string)
 	}
 
 	// RedisConf is a config proxy to redis.Options
@@ -87,6 +91,13 @@ func NewRedisConnect(conf RedisConf) *RedisConnect {
 	return c
 }
 
+// SetErrorHandler receives reconnect problems, it is called with the connection lock held and must not use redis.
+func (c *RedisConnect) SetErrorHandler(handler func(key string, message string)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onError = handler
+}
+
 func (c *RedisConnect) GetConnection() *redis.Client {
 	var err error
 
@@ -106,10 +117,16 @@ func (c *RedisConnect) GetConnection() *redis.Client {
 		}
 	}
 
+	attempts := 0
 	for {
 		c.cli = redis.NewClient(c.conf.ResolveOptions())
 
 		if err = c.cli.Ping().Err(); err != nil {
+			if attempts%ReconnectAlertEvery == 0 && c.onError != nil {
+				c.onError("redis_unavailable", fmt.Sprintf("Redis недоступний (%s:%s), спроба %d: %s", c.conf.Host, c.conf.Port, attempts+1, err))
+			}
+			attempts++
+
 			err = c.cli.Close()
 			if err != nil {
 				fmt.Printf("[REDIS] close after PING after open connection err {%s}", err)
@@ -123,6 +140,10 @@ func (c *RedisConnect) GetConnection() *redis.Client {
 		break
 	}
 
+	if attempts > 0 && c.onError != nil {
+		c.onError("redis_restored", fmt.Sprintf("Redis знову доступний після %d спроб", attempts))
+	}
+
 	c.lock.Unlock()
 
 	return c.cli
@@ -0,0 +1,32 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeoutLineSilentAcrossRestart(t *testing.T) {
+	now := time.Now()
+	m, transitions := newCorrelatedMonitor(map[string]time.Time{
+		"line": now.Add(-time.Hour),
+	})
+	m.SetCorrelation(CorrelationConf{})
+
+	// within its timeout after the restart the line may still check in
+	m.restoredAt = now
+	m.checkDevice("line", now)
+	if transitions.len() != 0 {
+		t.Fatalf("transitions %s during the restart grace", transitions.states("line"))
+	}
+
+	m.restoredAt = now.Add(-time.Minute)
+	m.checkDevice("line", now)
+
+	if got := transitions.states("line"); got != "off" {
+		t.Fatalf("transitions %s, want off", got)
+	}
+
+	if at := transitions.items[0].At; !at.Equal(m.restoredAt) {
+		t.Fatalf("off at %s, want the restart %s", at, m.restoredAt)
+	}
+}
@@ -1,5 +1,7 @@
 package core
 
+import "github.com/go-redis/redis"
+
 type RedisStorage struct {
 	redis *RedisConnect
 }
@@ -33,3 +35,67 @@ func (s *RedisStorage) Get(key string) (string, error) {
 
 	return r, nil
 }
+
+func (s *RedisStorage) Push(key string, value string, limit int64) error {
+	cli := s.redis.GetConnection()
+
+	if err := cli.LPush(key, value).Err(); err != nil {
+		return err
+	}
+
+	if limit > 0 {
+		return cli.LTrim(key, 0, limit-1).Err()
+	}
+
+	return nil
+}
+
+func (s *RedisStorage) Range(key string, start int64, stop int64) ([]string, error) {
+	return s.redis.GetConnection().LRange(key, start, stop).Result()
+}
+
+func (s *RedisStorage) SetFields(key string, fields map[string]interface{}) error {
+	return s.redis.GetConnection().HMSet(key, fields).Err()
+}
+
+// SetFieldsPipelined writes every hash and adds the members to the set in one round trip
+func (s *RedisStorage) SetFieldsPipelined(hashes map[string]map[string]interface{}, set string, members []string) error {
+	_, err := s.redis.GetConnection().Pipelined(func(pipe redis.Pipeliner) error {
+		for key, fields := range hashes {
+			pipe.HMSet(key, fields)
+		}
+
+		if len(members) > 0 {
+			args := make([]interface{}, len(members))
+			for i, member := range members {
+				args[i] = member
+			}
+
+			pipe.SAdd(set, args...)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (s *RedisStorage) GetFields(key string) (map[string]string, error) {
+	return s.redis.GetConnection().HGetAll(key).Result()
+}
+
+func (s *RedisStorage) AddMember(key string, member string) error {
+	return s.redis.GetConnection().SAdd(key, member).Err()
+}
+
+func (s *RedisStorage) RemoveMember(key string, member string) error {
+	return s.redis.GetConnection().SRem(key, member).Err()
+}
+
+func (s *RedisStorage) Members(key string) ([]string, error) {
+	return s.redis.GetConnection().SMembers(key).Result()
+}
+
+func (s *RedisStorage) Delete(key string) error {
+	return s.redis.GetConnection().Del(key).Err()
+}
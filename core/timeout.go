@@ -0,0 +1,90 @@
+package core
+
+import (
+	"go-meshtastic-monitor/comunication"
+	"math"
+	"time"
+)
+
+const DefaultAdaptiveSamples = 50
+const AdaptiveMinSamples = 10
+
+// AdaptiveConf enables timeouts learned from the observed heartbeat gaps instead of
+// the fixed Interval * IntervalCoefficient. Bounds are in seconds, zero means no bound.
+type AdaptiveConf struct {
+	Enabled    bool  `yaml:"enabled"`
+	MinTimeout int64 `yaml:"min_timeout"`
+	MaxTimeout int64 `yaml:"max_timeout"`
+	Samples    int   `yaml:"samples"`
+}
+
+func (m *Monitor) SetAdaptiveTimeout(conf AdaptiveConf) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	if conf.Samples <= 0 {
+		conf.Samples = DefaultAdaptiveSamples
+	}
+
+	m.adaptive = conf
+}
+
+// recordArrival stores the gap since the previous heartbeat. Gaps of an outage are not jitter and are skipped.
+func (m *Monitor) recordArrival(d *comunication.Device, now time.Time) {
+	if !m.adaptive.Enabled || d.LastSeen.IsZero() || d.IsTimeout() {
+		return
+	}
+
+	d.Arrivals.Add(now.Sub(d.LastSeen).Seconds(), m.adaptive.Samples)
+}
+
+// learnedTimeout covers both the spread of the gaps and the longest gap seen, so a single
+// lost heartbeat in the window keeps the timeout above two intervals. Zero until enough samples.
+func (m *Monitor) learnedTimeout(d comunication.Device) int64 {
+	if !m.adaptive.Enabled || d.Arrivals.Count() < AdaptiveMinSamples {
+		return 0
+	}
+
+	learned := math.Max(d.Arrivals.Mean()+4*d.Arrivals.Jitter(), d.Arrivals.Max()*1.25)
+	timeout := int64(math.Ceil(learned))
+
+	lower := d.Interval
+	if m.adaptive.MinTimeout > lower {
+		lower = m.adaptive.MinTimeout
+	}
+
+	if timeout < lower {
+		timeout = lower
+	}
+
+	if m.adaptive.MaxTimeout > 0 && timeout > m.adaptive.MaxTimeout {
+		timeout = m.adaptive.MaxTimeout
+	}
+
+	return timeout
+}
+
+func (m *Monitor) timeout(d comunication.Device) int64 {
+	return PolicyTimeout(d, m.learnedTimeout(d))
+}
+
+// PolicyTimeout applies the complex and device policy: the multiplier replaces IntervalCoefficient
+// when there is no learned timeout, then the minimum and the grace period are applied.
+func PolicyTimeout(d comunication.Device, learned int64) int64 {
+	policy := d.Complex.DeviceTimeoutPolicy(d.MacAddress)
+	timeout := learned
+
+	if timeout == 0 {
+		if policy.IntervalMultiplier > 0 {
+			timeout = int64(math.Ceil(float64(d.Interval) * policy.IntervalMultiplier))
+		} else {
+			timeout = d.Interval * IntervalCoefficient
+		}
+	}
+
+	if timeout < policy.MinTimeout {
+		timeout = policy.MinTimeout
+	}
+
+	return timeout + policy.Grace
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const SignatureHeader = "X-Power-Monitor-Signature"
+const TimestampHeader = "X-Power-Monitor-Timestamp"
+const DefaultWebhookRetries = 5
+const WebhookQueueSize = 100
+
+type WebhookTarget struct {
+	Url        string   `json:"url" yaml:"url"`
+	Secret     string   `json:"secret" yaml:"secret"`
+	Complexes  []string `json:"complexes" yaml:"complexes"`
+	MaxRetries int      `json:"max_retries" yaml:"max_retries"`
+	TimeoutSec int64    `json:"timeout_s" yaml:"timeout_s"`
+}
+
+type WebhookComplex struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+}
+
+type WebhookPayload struct {
+	Complex                      WebhookComplex `json:"complex"`
+	Line                         string         `json:"line"`
+	MacAddress                   string         `json:"mac"`
+	State                        string         `json:"state"`
+	Timestamp                    time.Time      `json:"timestamp"`
+	PreviousState                string         `json:"previous_state"`
+	PreviousStateDurationSeconds int64          `json:"previous_state_duration_s"`
+	ScheduleStatus               string         `json:"schedule_status"`
+	Backfilled                   bool           `json:"backfilled"`
+}
+
+type webhookWorker struct {
+	target WebhookTarget
+	queue  chan Transition
+	client *http.Client
+}
+
+// WebhookTransport POSTs every transition as signed JSON to the configured URLs.
+// Every target has its own queue, so a slow receiver does not delay the others and order is kept.
+type WebhookTransport struct {
+	workers  []*webhookWorker
+	n        *Notifier
+	schedule *Schedule
+	stopChan chan struct{}
+}
+
+func NewWebhookTransport(targets []WebhookTarget, notifier *Notifier, schedule *Schedule) *WebhookTransport {
+	t := &WebhookTransport{n: notifier, schedule: schedule, stopChan: make(chan struct{})}
+
+	for _, target := range targets {
+		if target.MaxRetries <= 0 {
+			target.MaxRetries = DefaultWebhookRetries
+		}
+
+		timeout := time.Duration(target.TimeoutSec) * time.Second
+		if timeout <= 0 {
+			timeout = 10 * time.Second
+		}
+
+		t.workers = append(t.workers, &webhookWorker{
+			target: target,
+			queue:  make(chan Transition, WebhookQueueSize),
+			client: &http.Client{Timeout: timeout},
+		})
+	}
+
+	return t
+}
+
+func (t *WebhookTransport) Start() {
+	for _, w := range t.workers {
+		go t.run(w)
+	}
+}
+
+// Stop ends the workers, the queues stay open because ingestion may still deliver transitions
+func (t *WebhookTransport) Stop() {
+	close(t.stopChan)
+}
+
+func (t *WebhookTransport) HandleTransition(tr Transition) {
+	select {
+	case <-t.stopChan:
+		return
+	default:
+	}
+
+	for _, w := range t.workers {
+		if !w.accepts(tr.ComplexKey) {
+			continue
+		}
+
+		select {
+		case w.queue <- tr:
+		default:
+			t.n.Alert(tr.Device.Complex, "webhook_queue_full:"+w.target.Url, fmt.Sprintf("Черга webhook %s переповнена, подію \"%s\" втрачено", w.target.Url, tr.DeviceName))
+		}
+	}
+}
+
+func (t *WebhookTransport) run(w *webhookWorker) {
+	for {
+		var tr Transition
+
+		select {
+		case tr = <-w.queue:
+		case <-t.stopChan:
+			return
+		}
+
+		body, err := json.Marshal(t.payload(tr))
+
+		if err != nil {
+			log.Println("[ERROR] Failed to marshal webhook payload:", err.Error())
+
+			continue
+		}
+
+		for attempt := 0; ; attempt++ {
+			err = w.deliver(body)
+
+			if err == nil {
+				break
+			}
+
+			if attempt >= w.target.MaxRetries {
+				t.n.Alert(tr.Device.Complex, "webhook_failed:"+w.target.Url, fmt.Sprintf("Webhook %s не прийняв подію \"%s\" після %d спроб: %s", w.target.Url, tr.DeviceName, attempt+1, err.Error()))
+
+				break
+			}
+
+			select {
+			case <-time.After(time.Duration(1<<attempt) * time.Second):
+			case <-t.stopChan:
+				return
+			}
+		}
+	}
+}
+
+func (t *WebhookTransport) payload(tr Transition) WebhookPayload {
+	return WebhookPayload{
+		Complex:                      WebhookComplex{Key: tr.ComplexKey, Name: tr.ComplexName},
+		Line:                         tr.DeviceName,
+		MacAddress:                   tr.MacAddress,
+		State:                        tr.State,
+		Timestamp:                    tr.At,
+		PreviousState:                tr.From,
+		PreviousStateDurationSeconds: int64(tr.PreviousDuration().Seconds()),
+		ScheduleStatus:               t.schedule.GetScheduleStatus(tr.Device.Complex.DeviceGroupMap[tr.MacAddress], tr.At),
+		Backfilled:                   tr.Backfilled,
+	}
+}
+
+func (w *webhookWorker) accepts(complexKey string) bool {
+	if len(w.target.Complexes) == 0 {
+		return true
+	}
+
+	for _, key := range w.target.Complexes {
+		if key == complexKey {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *webhookWorker) deliver(body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, w.target.Url, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, "sha256="+Sign(w.target.Secret, timestamp, body))
+
+	resp, err := w.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Sign returns hex HMAC-SHA256 of "<timestamp>.<body>", receivers should also reject stale timestamps.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go-meshtastic-monitor/comunication"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	at        time.Time
+	timestamp string
+	signature string
+	body      []byte
+}
+
+func newWebhookReceiver(t *testing.T, status int) (*httptest.Server, chan webhookRequest) {
+	requests := make(chan webhookRequest, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		requests <- webhookRequest{
+			at:        time.Now(),
+			timestamp: r.Header.Get(TimestampHeader),
+			signature: r.Header.Get(SignatureHeader),
+			body:      body,
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func webhookTransition() Transition {
+	d := comunication.Device{
+		Key:        "k",
+		Name:       "Квартира",
+		MacAddress: "aa:bb",
+		Complex:    comunication.Complex{Key: "k", Name: "Дім"},
+	}
+	at := time.Unix(1700003600, 0)
+	t := NewTransition(d, StateOn, at, at.Add(-time.Hour))
+	t.From = StateOff
+
+	return t
+}
+
+func receive(t *testing.T, requests chan webhookRequest) webhookRequest {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	return webhookRequest{}
+}
+
+func TestWebhookSignsPayload(t *testing.T) {
+	server, requests := newWebhookReceiver(t, http.StatusNoContent)
+
+	notifier := NewNotifier("", OperatorConf{}, nil)
+	transport := NewWebhookTransport([]WebhookTarget{{Url: server.URL, Secret: "secret"}}, notifier, NewSchedule(nil))
+	transport.Start()
+	defer transport.Stop()
+
+	transport.HandleTransition(webhookTransition())
+	r := receive(t, requests)
+
+	// receivers verify HMAC-SHA256 of "<timestamp>.<body>" with the shared secret
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(r.timestamp + "."))
+	mac.Write(r.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.signature != want {
+		t.Fatalf("signature %s, want %s", r.signature, want)
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(r.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.State != StateOn || payload.PreviousState != StateOff || payload.PreviousStateDurationSeconds != 3600 || payload.MacAddress != "aa:bb" || payload.Complex.Key != "k" {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+}
+
+func TestWebhookRetriesAndAlerts(t *testing.T) {
+	server, requests := newWebhookReceiver(t, http.StatusServiceUnavailable)
+
+	notifier := NewNotifier("", OperatorConf{}, nil)
+	transport := NewWebhookTransport([]WebhookTarget{{Url: server.URL, Secret: "secret", MaxRetries: 2}}, notifier, NewSchedule(nil))
+	transport.Start()
+	defer transport.Stop()
+
+	transport.HandleTransition(webhookTransition())
+
+	// the first attempt and two retries after 1s and 2s
+	var attempts []webhookRequest
+	for i := 0; i < 3; i++ {
+		attempts = append(attempts, receive(t, requests))
+	}
+
+	for i, want := range []time.Duration{time.Second, 2 * time.Second} {
+		if gap := attempts[i+1].at.Sub(attempts[i].at); gap < want {
+			t.Fatalf("retry %d after %s, want at least %s", i+1, gap, want)
+		}
+	}
+
+	select {
+	case a := <-notifier.alerts:
+		if !strings.Contains(a.Message, server.URL) || !strings.Contains(a.Message, "3 спроб") {
+			t.Fatalf("unexpected alert %s", a.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("operators were not alerted")
+	}
+
+	select {
+	case r := <-requests:
+		t.Fatalf("delivered again after the retries ran out at %s", r.at)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
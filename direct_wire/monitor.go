@@ -1,7 +1,6 @@
 package direct_wire
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"go-meshtastic-monitor/comunication"
@@ -20,159 +19,310 @@ type DirectWireMonitor struct {
 	devices   map[string]comunication.Device
 	complexes map[string]comunication.Complex
 
-	rw       sync.RWMutex
-	notifier *core.Notifier
-	storage  *core.RedisStorage
+	rw        sync.RWMutex
+	notifier  *core.Notifier
+	storage   *core.RedisStorage
+	deadlines *core.Deadlines
+	store     *core.DeviceStore
+
+	restoredAt time.Time
 }
 
 func NewDirectWireMonitor(notifier *core.Notifier, complexes []comunication.Complex, storage *core.RedisStorage) *DirectWireMonitor {
-
-	return &DirectWireMonitor{
+	m := &DirectWireMonitor{
 		devices:   make(map[string]comunication.Device),
 		complexes: core.ToMap(complexes),
 		notifier:  notifier,
 		storage:   storage,
 	}
+	m.deadlines = core.NewDeadlines(m.checkDevice)
+	m.store = core.NewDeviceStore(storage, DevicesBackupKey)
+
+	return m
 }
 
-func (m *DirectWireMonitor) Restore() {
+// Start watches devices that report their interval: without data for the policy timeout
+// the line becomes unreachable instead of keeping the last reported power state.
+func (m *DirectWireMonitor) Start() {
+	go m.store.Start()
+	m.rw.RLock()
+	for mac := range m.devices {
+		m.deadlines.Schedule(mac, time.Now())
+	}
+	m.rw.RUnlock()
+
+	m.deadlines.Start()
+}
+
+func (m *DirectWireMonitor) Stop() {
+	m.deadlines.Stop()
+	m.store.Stop()
+}
+
+func (m *DirectWireMonitor) checkDevice(mac string, _ time.Time) {
 	m.rw.Lock()
 	defer m.rw.Unlock()
-	data, err := m.storage.Get(DevicesBackupKey)
-
-	if err != nil {
-		log.Println("[ERROR] Failed to restore data from storage:", err.Error())
+	device, ok := m.devices[mac]
 
+	if !ok || device.Interval <= 0 {
 		return
 	}
 
-	if data == "" {
-		log.Println("[ERROR] Failed to restore data from storage. Data is empty.")
+	if c, ok := m.complexes[device.Key]; ok {
+		device.Complex = c
+	}
+	device.Timeout = core.PolicyTimeout(device, 0)
+	m.devices[mac] = device
+
+	if !device.IsTimeout() {
+		m.deadlines.Schedule(mac, device.TimeoutAt())
 
 		return
 	}
-	var devices []comunication.Device
-	err = json.Unmarshal([]byte(data), &devices)
 
-	if err != nil {
-		log.Println("[ERROR] Failed to restore data from storage:", err.Error())
+	// after a restart every device gets its own timeout to check in before it is reported
+	if graceUntil := m.restoredAt.Add(time.Duration(device.Timeout) * time.Second); device.LastSeen.Before(m.restoredAt) && time.Now().Before(graceUntil) {
+		m.deadlines.Schedule(mac, graceUntil)
 
 		return
 	}
 
-	fmt.Println("[INFO] Restored devices:", devices)
+	// a hybrid device going silent is a power off, a direct wire one only lost its monitoring
+	input := comunication.InputLost
+	if device.IsHybrid {
+		input = comunication.InputPowerOff
+	}
 
-	m.devices = m.toMap(devices)
-}
+	// a hybrid device silent since before the restart is off from the restart on, its state during the downtime is unknown
+	at := device.LastSeen
+	downtime := device.IsHybrid && device.LastSeen.Before(m.restoredAt)
+	if downtime {
+		at = m.restoredAt
+	}
 
-func (m *DirectWireMonitor) Backup() {
-	m.rw.RLock()
-	defer m.rw.RUnlock()
+	event, changed := m.notifier.ApplyLine(&device, input, at)
 
-	if len(m.devices) == 0 {
-		log.Println("[INFO] No devices to backup")
+	if !changed {
 		return
 	}
 
-	b, err := json.Marshal(m.fromMap(m.devices))
+	message := device.GenerateMonitoringLostMessage()
+	if device.IsHybrid {
+		message = device.GeneratePowerOffMessage()
+		if downtime {
+			message = device.GenerateDowntimeOffMessage(m.restoredAt)
+		}
+		device.IsPluggedIn = false
+		device.PowerOffAt = at
+	}
 
-	if err != nil {
-		log.Println("Error marshalling devices:", err.Error())
+	m.devices[mac] = device
+	m.notifier.Transition(core.NewLineTransition(device, event))
+	m.store.Save(device)
+
+	if event.ShouldNotify() {
+		m.notifier.Notify(core.Notification{
+			Device:  device,
+			Message: message,
+		})
+	}
+}
+
+// Restore reads the per device hashes written on every transition, the snapshot list of older versions is migrated.
+func (m *DirectWireMonitor) Restore() {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	devices, legacy := m.store.Restore()
+
+	fmt.Println("[INFO] Restored devices:", len(devices))
+
+	for mac, device := range devices {
+		if device.Line.State != "" {
+			continue
+		}
+
+		if device.IsPluggedIn {
+			device.Line = comunication.RestoredLine(comunication.LineOn, device.PowerOnAt)
+		} else {
+			device.Line = comunication.RestoredLine(comunication.LineOff, device.PowerOffAt)
+		}
+		devices[mac] = device
+	}
 
+	if len(devices) == 0 {
 		return
 	}
 
-	err = m.storage.Store(DevicesBackupKey, string(b))
-	if err != nil {
-		log.Println("Error storing devices:", err.Error())
+	if legacy {
+		m.store.Migrate(devices)
+	}
+
+	m.devices = devices
+	m.restoredAt = time.Now()
+}
+
+// Snapshot writes every device to its hash, transitions are written as they happen.
+// The devices are copied under the lock and written without it.
+func (m *DirectWireMonitor) Snapshot() {
+	m.rw.RLock()
+	devices := m.fromMap(m.devices)
+	copiedAt := time.Now()
+	m.rw.RUnlock()
+
+	m.store.SaveAll(devices, copiedAt)
+}
+
+func (m *DirectWireMonitor) Backup() {
+	// transitions queued before the stop are written first
+	m.store.Flush()
 
+	m.rw.RLock()
+	devices := m.fromMap(m.devices)
+	copiedAt := time.Now()
+	m.rw.RUnlock()
+
+	if len(devices) == 0 {
+		log.Println("[INFO] No devices to backup")
 		return
 	}
 
+	m.store.SaveAll(devices, copiedAt)
+
 	log.Println("[INFO] Backup complete")
 }
 
+// SyncMutes applies a mute change to the lines at once instead of waiting for their next input
+func (m *DirectWireMonitor) SyncMutes() {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	now := time.Now()
+
+	for mac, device := range m.devices {
+		if !m.notifier.SyncMute(&device, now) {
+			continue
+		}
+
+		m.devices[mac] = device
+		m.store.Save(device)
+	}
+}
+
 func (m *DirectWireMonitor) UpdateComplexes(complexes []comunication.Complex) {
 	m.rw.Lock()
 	defer m.rw.Unlock()
 	m.complexes = core.ToMap(complexes)
+
+	for mac := range m.devices {
+		m.deadlines.Schedule(mac, time.Now())
+	}
 }
 
 func (m *DirectWireMonitor) HandleDevice(device comunication.Device) {
 	m.rw.Lock()
 	defer m.rw.Unlock()
 
-	_, exist := m.devices[device.MacAddress]
 	c, err := m.findComplex(device.Key)
 
 	if err != nil {
-		if exist {
+		if _, exist := m.devices[device.MacAddress]; exist {
 			delete(m.devices, device.MacAddress)
+			m.deadlines.Cancel(device.MacAddress)
+			m.store.Delete(device.MacAddress)
+			m.notifier.RemoveLine(device.MacAddress)
 		}
 
+		m.notifier.Alert(comunication.Complex{}, "unknown_key:"+device.MacAddress, fmt.Sprintf("Пристрій \"%s\" (%s) надсилає дані з невідомим ключем комплексу \"%s\"", device.Name, device.MacAddress, device.Key))
+
 		return
 	}
-	device.Complex = c
-
-	if exist {
-		existingDevice := m.devices[device.MacAddress]
-
-		existingDevice.Complex = c
-		existingDevice.LastSeen = time.Now()
-		existingDevice.IsPluggedIn = device.IsPluggedIn
-		device.NotificationEnabled = existingDevice.NotificationEnabled
+	now := time.Now()
+	stored, exist := m.devices[device.MacAddress]
+
+	if !exist {
+		stored = device
+		stored.NotificationEnabled = true
+		stored.Line = comunication.NewLine()
+		stored.Arrivals = comunication.ArrivalStats{}
+		fmt.Printf("Registered %v\n", device)
+	}
 
-		m.devices[device.MacAddress] = existingDevice
+	wasPluggedIn := stored.IsPluggedIn
+	stored.Complex = c
+	stored.LastSeen = now
+	stored.Interval = device.Interval
+	stored.IsHybrid = device.IsHybrid
+	stored.IsPluggedIn = device.IsPluggedIn
+	if device.Telemetry != nil {
+		stored.Telemetry = device.Telemetry
+	}
 
-		if !device.IsPluggedIn {
-			if !existingDevice.DownNotificationSend {
-				device.DownNotificationSend = true
-				device.UpNotificationSend = false
-				fmt.Printf("Detected power off %+v\n", device)
+	if stored.Interval > 0 {
+		stored.Timeout = core.PolicyTimeout(stored, 0)
+		m.deadlines.Schedule(stored.MacAddress, stored.TimeoutAt())
+	} else {
+		m.deadlines.Cancel(stored.MacAddress)
+	}
 
-				m.notifier.Notify(core.Notification{
-					Device:  existingDevice,
-					Message: existingDevice.GeneratePowerOffMessageOnline(),
-				})
-				device.PowerOffAt = time.Now()
-				m.devices[device.MacAddress] = device
+	input := comunication.InputPowerOff
+	if device.IsPluggedIn {
+		input = comunication.InputPowerOn
+	}
 
-				return
-			}
-		} else {
-			if !existingDevice.UpNotificationSend {
-				device.UpNotificationSend = true
-				device.DownNotificationSend = false
-				fmt.Printf("Detected power on %+v\n", device)
+	event, changed := m.notifier.ApplyLine(&stored, input, now)
 
-				m.notifier.Notify(core.Notification{
-					Device:  existingDevice,
-					Message: existingDevice.GeneratePowerOnMessageOnline(),
-				})
-				device.PowerOnAt = time.Now()
+	if !changed {
+		m.devices[device.MacAddress] = stored
 
-				m.devices[device.MacAddress] = device
+		return
+	}
 
-				return
-			}
-		}
+	var message string
+	if event.From == comunication.LineUnreachable {
+		// the moment of the change is unknown, the power state kept its timestamp if it did not change
+		message = stored.GenerateMonitoringRestoredMessage()
+	} else if event.To == comunication.LineOn {
+		message = stored.GeneratePowerOnMessageOnline()
 	} else {
-		if device.IsPluggedIn {
-			device.PowerOnAt = time.Now()
-			device.UpNotificationSend = true
-			device.DownNotificationSend = false
+		message = stored.GeneratePowerOffMessageOnline()
+	}
+
+	if event.From != comunication.LineUnreachable || wasPluggedIn != stored.IsPluggedIn {
+		if event.To == comunication.LineOn {
+			stored.PowerOnAt = now
 		} else {
-			device.PowerOffAt = time.Now()
-			device.DownNotificationSend = true
-			device.UpNotificationSend = true
+			stored.PowerOffAt = now
 		}
+	}
 
-		device.NotificationEnabled = true
+	m.devices[device.MacAddress] = stored
+	m.notifier.Transition(core.NewLineTransition(stored, event))
+	m.store.Save(stored)
 
-		fmt.Printf("Registered %v\n", device)
+	if event.ShouldNotify() {
+		fmt.Printf("Detected power %s %+v\n", event.To, stored)
+		m.notifier.Notify(core.Notification{
+			Device:  stored,
+			Message: message,
+		})
+	}
+}
 
-		m.devices[device.MacAddress] = device
+// Backfill applies events the device recorded offline, false when the device is not known
+func (m *DirectWireMonitor) Backfill(key string, mac string, events []comunication.DeviceEvent) bool {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	device, ok := m.devices[mac]
+
+	// the complex key is the only credential, another complex must not rewrite the history
+	if !ok || device.Key != key {
+		return false
 	}
+
+	m.notifier.Backfill(&device, events, time.Now())
+	m.devices[mac] = device
+	m.store.Save(device)
+
+	return true
 }
 
 func (m *DirectWireMonitor) UpdatePowerOnAt(mac string) {
@@ -201,6 +351,7 @@ func (m *DirectWireMonitor) UpdateNotification(mac string, notificationEnabled b
 	device.NotificationEnabled = notificationEnabled
 
 	m.devices[mac] = device
+	m.store.Save(device)
 }
 
 func (m *DirectWireMonitor) GetStatus() map[string]comunication.Device {
@@ -235,11 +386,36 @@ func (m *DirectWireMonitor) toMap(devices []comunication.Device) map[string]comu
 	return d
 }
 
+func (m *DirectWireMonitor) GetDevices(c comunication.Complex) []comunication.Device {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	var devices []comunication.Device
+	for _, device := range m.devices {
+		if device.Key == c.Key {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices
+}
+
+func (m *DirectWireMonitor) FindDevice(mac string) (comunication.Device, bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+	device, ok := m.devices[mac]
+
+	return device, ok
+}
+
 func (m *DirectWireMonitor) GetStatusText(c comunication.Complex) string {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
 	var msgs []string
 	for _, device := range m.devices {
 		if device.Key == c.Key {
-			msgs = append(msgs, device.GenerateStatusMessageOnline())
+			msgs = append(msgs, device.GenerateStatusMessage())
 		}
 	}
 
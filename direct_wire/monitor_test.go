@@ -0,0 +1,67 @@
+package direct_wire
+
+import (
+	"go-meshtastic-monitor/comunication"
+	"go-meshtastic-monitor/core"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedTransitions struct {
+	rw    sync.Mutex
+	items []core.Transition
+}
+
+func (r *recordedTransitions) HandleTransition(t core.Transition) {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+	r.items = append(r.items, t)
+}
+
+func TestHybridLineSilentAcrossRestart(t *testing.T) {
+	notifier := core.NewNotifier("", core.OperatorConf{}, nil)
+	transitions := &recordedTransitions{}
+	notifier.AddTransitionHandler(transitions)
+
+	c := comunication.Complex{Key: "k", Name: "Дім"}
+	m := NewDirectWireMonitor(notifier, []comunication.Complex{c}, nil)
+
+	now := time.Now()
+	lastSeen := now.Add(-time.Hour)
+	m.devices["line"] = comunication.Device{
+		Key:           c.Key,
+		Name:          "line",
+		MacAddress:    "line",
+		Interval:      10,
+		Complex:       c,
+		LastSeen:      lastSeen,
+		HasDirectWire: true,
+		IsHybrid:      true,
+		IsPluggedIn:   true,
+		Line:          comunication.RestoredLine(comunication.LineOn, lastSeen),
+	}
+
+	// within its timeout after the restart the line may still report
+	m.restoredAt = now
+	m.checkDevice("line", now)
+	if len(transitions.items) != 0 {
+		t.Fatalf("%d transitions during the restart grace", len(transitions.items))
+	}
+
+	// the state during the downtime is unknown, the line is off from the restart on
+	m.restoredAt = now.Add(-time.Minute)
+	m.checkDevice("line", now)
+
+	if len(transitions.items) != 1 || transitions.items[0].State != core.StateOff {
+		t.Fatalf("transitions %+v, want off", transitions.items)
+	}
+
+	if at := transitions.items[0].At; !at.Equal(m.restoredAt) {
+		t.Fatalf("off at %s, want the restart %s", at, m.restoredAt)
+	}
+
+	if device := m.devices["line"]; !device.PowerOffAt.Equal(m.restoredAt) || device.IsPluggedIn {
+		t.Fatalf("device not off since the restart: %+v", device)
+	}
+}
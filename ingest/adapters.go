@@ -0,0 +1,256 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"go-meshtastic-monitor/comunication"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errUnknownState = errors.New("power state not found in request")
+
+// DeviceFromQuery reads the short fields k, n, m, i, h and p from a query string,
+// for firmware that can only call a URL.
+func DeviceFromQuery(q url.Values) (comunication.Device, error) {
+	d := identity(q)
+
+	if v := q.Get("i"); v != "" {
+		interval, err := strconv.ParseInt(v, 10, 64)
+
+		if err != nil {
+			return d, errors.New("i must be a number")
+		}
+
+		d.Interval = interval
+	}
+
+	if v := q.Get("h"); v != "" {
+		h, ok := parseBool(v)
+
+		if !ok {
+			return d, errors.New("h must be a boolean")
+		}
+
+		d.HasDirectWire = h
+	}
+
+	if v := q.Get("p"); v != "" {
+		p, ok := parseBool(v)
+
+		if !ok {
+			return d, errors.New("p must be a boolean")
+		}
+
+		d.IsPluggedIn = p
+	}
+
+	return d, nil
+}
+
+// ShellyDevice maps a Shelly action (Gen1) or webhook (Gen2) call onto a direct wire device.
+// The line is identified by k, n and m in the URL, the state is taken from, in order:
+// "state" query parameter (e.g. ${status["input:0"].state}), "event" query parameter
+// (btn_on, out_off, input.toggle_on, switch.off, ...) or a Gen2 NotifyStatus/NotifyEvent JSON body.
+// "c" selects the component, e.g. input:1, the first input or switch is used by default.
+func ShellyDevice(q url.Values, body []byte) (comunication.Device, error) {
+	d := identity(q)
+	d.HasDirectWire = true
+
+	if v := q.Get("state"); v != "" {
+		p, ok := parseBool(v)
+
+		if !ok {
+			return d, errUnknownState
+		}
+
+		d.IsPluggedIn = p
+
+		return d, nil
+	}
+
+	if v := q.Get("event"); v != "" {
+		p, ok := parseShellyEvent(v)
+
+		if !ok {
+			return d, errUnknownState
+		}
+
+		d.IsPluggedIn = p
+
+		return d, nil
+	}
+
+	p, ok := parseShellyNotification(body, q.Get("c"))
+
+	if !ok {
+		return d, errUnknownState
+	}
+
+	d.IsPluggedIn = p
+
+	return d, nil
+}
+
+// TasmotaDevice maps a Tasmota WebQuery/WebSend call onto a direct wire device.
+// Accepted states: "state" or "power" query parameters, or a JSON body like {"POWER":"ON"},
+// {"POWER1":"OFF"}, {"Switch1":{"Action":"ON"}} or {"Switch1":"OFF"}. "c" selects the key, e.g. Switch2.
+func TasmotaDevice(q url.Values, body []byte) (comunication.Device, error) {
+	d := identity(q)
+	d.HasDirectWire = true
+
+	for _, name := range []string{"state", "power"} {
+		if v := q.Get(name); v != "" {
+			p, ok := parseBool(v)
+
+			if !ok {
+				return d, errUnknownState
+			}
+
+			d.IsPluggedIn = p
+
+			return d, nil
+		}
+	}
+
+	var payload map[string]json.RawMessage
+	if json.Unmarshal(body, &payload) != nil {
+		return d, errUnknownState
+	}
+
+	for _, key := range candidateKeys(payload, q.Get("c"), "POWER", "SWITCH") {
+		var state string
+		if json.Unmarshal(payload[key], &state) == nil {
+			if p, ok := parseBool(state); ok {
+				d.IsPluggedIn = p
+
+				return d, nil
+			}
+		}
+
+		var action struct {
+			Action string `json:"Action"`
+		}
+		if json.Unmarshal(payload[key], &action) == nil {
+			if p, ok := parseBool(action.Action); ok {
+				d.IsPluggedIn = p
+
+				return d, nil
+			}
+		}
+	}
+
+	return d, errUnknownState
+}
+
+func identity(q url.Values) comunication.Device {
+	return comunication.Device{
+		Key:        q.Get("k"),
+		Name:       q.Get("n"),
+		MacAddress: q.Get("m"),
+	}
+}
+
+func parseBool(v string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "1", "true", "on", "yes":
+		return true, true
+	case "0", "false", "off", "no":
+		return false, true
+	}
+
+	return false, false
+}
+
+func parseShellyEvent(event string) (bool, bool) {
+	event = strings.ToLower(event)
+
+	switch {
+	case strings.HasSuffix(event, "_on"), strings.HasSuffix(event, ".on"):
+		return true, true
+	case strings.HasSuffix(event, "_off"), strings.HasSuffix(event, ".off"):
+		return false, true
+	}
+
+	return false, false
+}
+
+func parseShellyNotification(body []byte, component string) (bool, bool) {
+	var notification struct {
+		Params map[string]json.RawMessage `json:"params"`
+	}
+
+	if json.Unmarshal(body, &notification) != nil || notification.Params == nil {
+		return false, false
+	}
+
+	if raw, ok := notification.Params["events"]; ok {
+		var events []struct {
+			Component string `json:"component"`
+			Event     string `json:"event"`
+		}
+
+		if json.Unmarshal(raw, &events) == nil {
+			for _, e := range events {
+				if component != "" && e.Component != component {
+					continue
+				}
+
+				if p, ok := parseShellyEvent(e.Event); ok {
+					return p, true
+				}
+			}
+		}
+	}
+
+	for _, key := range candidateKeys(notification.Params, component, "input:", "switch:") {
+		var status struct {
+			State  *bool `json:"state"`
+			Output *bool `json:"output"`
+		}
+
+		if json.Unmarshal(notification.Params[key], &status) != nil {
+			continue
+		}
+
+		if status.State != nil {
+			return *status.State, true
+		}
+
+		if status.Output != nil {
+			return *status.Output, true
+		}
+	}
+
+	return false, false
+}
+
+// candidateKeys returns the explicitly selected key, or all keys starting with one of the prefixes in a stable order.
+func candidateKeys(payload map[string]json.RawMessage, selected string, prefixes ...string) []string {
+	if selected != "" {
+		for key := range payload {
+			if strings.EqualFold(key, selected) {
+				return []string{key}
+			}
+		}
+
+		return nil
+	}
+
+	var keys []string
+	for key := range payload {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(strings.ToUpper(key), strings.ToUpper(prefix)) {
+				keys = append(keys, key)
+
+				break
+			}
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,104 @@
+package ingest
+
+import (
+	"net/url"
+	"testing"
+)
+
+const query = "k=key&n=Квартира&m=aa:bb"
+
+// Gen2 webhooks and outbound websocket notifications as sent by a Shelly Plus 1
+const shellyNotifyStatus = `{"src":"shellyplus1-a8032ab12345","dst":"monitor","method":"NotifyStatus","params":{"ts":1700000000.52,"input:0":{"id":0,"state":false}}}`
+const shellyNotifyEvent = `{"src":"shellyplus1-a8032ab12345","dst":"monitor","method":"NotifyEvent","params":{"ts":1700000000.52,"events":[{"component":"input:0","id":0,"event":"toggle_on","ts":1700000000.52}]}}`
+const shellyTwoInputs = `{"method":"NotifyStatus","params":{"ts":1700000000.52,"input:0":{"id":0,"state":true},"input:1":{"id":1,"state":false}}}`
+const shellySwitch = `{"method":"NotifyStatus","params":{"ts":1700000000.52,"switch:0":{"id":0,"output":true}}}`
+
+func TestShellyDevice(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		body      string
+		pluggedIn bool
+		err       bool
+	}{
+		{"state query", query + "&state=true", "", true, false},
+		{"gen1 action", query + "&event=out_off", "", false, false},
+		{"gen2 event query", query + "&event=input.toggle_on", "", true, false},
+		{"notify status", query, shellyNotifyStatus, false, false},
+		{"notify event", query, shellyNotifyEvent, true, false},
+		{"selected component", query + "&c=input:1", shellyTwoInputs, false, false},
+		{"first input", query, shellyTwoInputs, true, false},
+		{"switch output", query, shellySwitch, true, false},
+		{"event of another component", query + "&c=input:1", shellyNotifyEvent, false, true},
+		{"unknown state", query + "&state=maybe", "", false, true},
+		{"empty body", query, "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d, err := ShellyDevice(q, []byte(tt.body))
+
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v", err)
+			}
+
+			if tt.err {
+				return
+			}
+
+			if d.IsPluggedIn != tt.pluggedIn || !d.HasDirectWire || d.Key != "key" || d.MacAddress != "aa:bb" || d.Name != "Квартира" {
+				t.Fatalf("unexpected device %+v", d)
+			}
+		})
+	}
+}
+
+func TestTasmotaDevice(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		body      string
+		pluggedIn bool
+		err       bool
+	}{
+		{"power query", query + "&power=ON", "", true, false},
+		{"power", query, `{"POWER":"OFF"}`, false, false},
+		{"power of relay", query, `{"POWER1":"ON"}`, true, false},
+		{"switch action", query, `{"Switch1":{"Action":"ON"}}`, true, false},
+		{"switch state", query, `{"Switch1":"OFF"}`, false, false},
+		{"selected switch", query + "&c=switch2", `{"Switch1":"ON","Switch2":"OFF"}`, false, false},
+		{"unknown action", query, `{"Switch1":{"Action":"TOGGLE"}}`, false, true},
+		{"no state", query, `{"Time":"2024-05-01T10:00:00"}`, false, true},
+		{"not json", query, `POWER ON`, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d, err := TasmotaDevice(q, []byte(tt.body))
+
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v", err)
+			}
+
+			if tt.err {
+				return
+			}
+
+			if d.IsPluggedIn != tt.pluggedIn || !d.HasDirectWire || d.MacAddress != "aa:bb" {
+				t.Fatalf("unexpected device %+v", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"go-meshtastic-monitor/comunication"
+	"go-meshtastic-monitor/core"
+	"go-meshtastic-monitor/direct_wire"
+)
+
+const KindDirect = "direct"
+const KindTimeout = "timeout"
+
+// KindHybrid reports p like a direct wire device and the interval like a timeout device:
+// p gives instant transitions and silence longer than the timeout means power off.
+const KindHybrid = "hybrid"
+
+// Router validates incoming heartbeats and hands them to the monitor responsible for their kind,
+// so every transport (HTTP, MQTT, ...) applies exactly the same rules.
+type Router struct {
+	monitor       *core.Monitor
+	onlineMonitor *direct_wire.DirectWireMonitor
+}
+
+func NewRouter(monitor *core.Monitor, onlineMonitor *direct_wire.DirectWireMonitor) *Router {
+	return &Router{
+		monitor:       monitor,
+		onlineMonitor: onlineMonitor,
+	}
+}
+
+func (r *Router) Route(kind string, d comunication.Device) error {
+	err := Validate(kind, d)
+
+	if err != nil {
+		return err
+	}
+
+	// queued events go before the heartbeat, so they replace the silence it ends. A device seen
+	// for the first time has no history yet and its events are dropped.
+	if len(d.Events) > 0 {
+		_ = r.Backfill(d)
+	}
+	d.Events = nil
+
+	switch kind {
+	case KindDirect:
+		d.IsHybrid = false
+		r.onlineMonitor.HandleDevice(d)
+	case KindHybrid:
+		d.HasDirectWire = true
+		d.IsHybrid = true
+		r.onlineMonitor.HandleDevice(d)
+	case KindTimeout:
+		r.monitor.AddDevice(d)
+	}
+
+	return nil
+}
+
+// Backfill applies events a known device of the complex d.Key recorded while it had no connection.
+func (r *Router) Backfill(d comunication.Device) error {
+	err := validateIdentity(d)
+
+	if err != nil {
+		return err
+	}
+
+	if r.onlineMonitor.Backfill(d.Key, d.MacAddress, d.Events) || r.monitor.Backfill(d.Key, d.MacAddress, d.Events) {
+		return nil
+	}
+
+	return errors.New("unknown device " + d.MacAddress)
+}
+
+// RouteJSON decodes the JSON payload used by /direct-wire, /timeout-wire and /hybrid-wire and routes it.
+func (r *Router) RouteJSON(kind string, payload []byte) error {
+	d := comunication.Device{}
+	err := json.Unmarshal(payload, &d)
+
+	if err != nil {
+		return err
+	}
+
+	return r.Route(kind, d)
+}
+
+func Validate(kind string, d comunication.Device) error {
+	if kind != KindDirect && kind != KindTimeout && kind != KindHybrid {
+		return errors.New("unknown device kind " + kind)
+	}
+
+	err := validateIdentity(d)
+
+	if err != nil {
+		return err
+	}
+
+	if (kind == KindTimeout || kind == KindHybrid) && d.Interval <= 0 {
+		return errors.New("i must be positive")
+	}
+
+	return nil
+}
+
+// validateIdentity checks the fields every payload must have, including /backfill without a kind
+func validateIdentity(d comunication.Device) error {
+	if d.Key == "" {
+		return errors.New("k is required")
+	}
+
+	if d.MacAddress == "" {
+		return errors.New("m is required")
+	}
+
+	if d.Name == "" {
+		return errors.New("n is required")
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"github.com/gin-gonic/gin"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -9,6 +10,13 @@ import (
 	"go-meshtastic-monitor/configuration"
 	"go-meshtastic-monitor/core"
 	"go-meshtastic-monitor/direct_wire"
+	"go-meshtastic-monitor/ingest"
+	"go-meshtastic-monitor/meshtastic"
+	"go-meshtastic-monitor/mqtt"
+	"go-meshtastic-monitor/nut"
+	"go-meshtastic-monitor/probe"
+	"go-meshtastic-monitor/telegram"
+	"go-meshtastic-monitor/udp"
 	"log"
 	"net/http"
 	"os"
@@ -18,6 +26,8 @@ import (
 	"time"
 )
 
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
 var (
 	config       configuration.Configuration
 	confFilePath string
@@ -64,13 +74,70 @@ func main() {
 	redisConnect := core.NewRedisConnect(config.Redis)
 	storage := core.NewRedisStorage(redisConnect)
 
-	n := core.NewNotifier(config.TelegramWebhookPattern)
-	monitor := core.NewMonitor(config.Complexes, n, storage)
+	n := core.NewNotifier(config.TelegramWebhookPattern, config.Operator, storage)
+	redisConnect.SetErrorHandler(func(key string, message string) {
+		n.Alert(comunication.Complex{}, key, message)
+	})
+	var groups []comunication.Groups
+	if config.ScheduleFile != "" {
+		groups = core.ParseSchedules(config.ScheduleFile)
+	}
+	schedule := core.NewSchedule(groups)
+	monitor := core.NewMonitor(config.Complexes, n, storage, schedule)
+	monitor.SetAdaptiveTimeout(config.AdaptiveTimeout)
+	monitor.SetCorrelation(config.Correlation)
 	onlineMonitor := direct_wire.NewDirectWireMonitor(n, config.Complexes, storage)
+	probeMonitor := probe.NewProbeMonitor(n, config.Complexes, storage)
+	history := core.NewHistory(storage)
+	n.AddTransitionHandler(history)
+	followUps := core.NewFollowUps(n, storage)
+	n.AddTransitionHandler(followUps)
+	webhooks := core.NewWebhookTransport(config.OutgoingWebhooks, n, schedule)
+	n.AddTransitionHandler(webhooks)
+
+	router := ingest.NewRouter(monitor, onlineMonitor)
+
+	var publisher *mqtt.Publisher
+	var subscriber *mqtt.Subscriber
+	if config.Mqtt.Broker != "" {
+		publisher = mqtt.NewPublisher(config.Mqtt)
+		n.AddTransitionHandler(publisher)
+
+		if len(config.Mqtt.Subscriptions) > 0 {
+			subscriber = mqtt.NewSubscriber(config.Mqtt, router)
+		}
+	}
+
+	meshtasticAdapter := meshtastic.NewAdapter(config.Meshtastic, router)
+	var meshtasticClients []*meshtastic.TcpClient
+	for _, address := range config.Meshtastic.Tcp {
+		meshtasticClients = append(meshtasticClients, meshtastic.NewTcpClient(address, meshtasticAdapter))
+	}
+	if subscriber != nil {
+		subscriber.AddHandler(meshtastic.KindMeshtastic, meshtasticAdapter.HandleJSON)
+	}
+
+	nutPoller := nut.NewPoller(config.Nut, router, n)
+
+	udpListener := udp.NewListener(config.Udp, router, storage)
+	if config.Udp.Bind != "" {
+		if err := udpListener.Start(); err != nil {
+			log.Fatal("[MAIN] failed to start udp listener: ", err)
+		}
+	}
+	commands := telegram.NewCommands(monitor, onlineMonitor, probeMonitor, history, n.Mutes(), schedule)
+	n.Mutes().AddChangeHandler(monitor.SyncMutes)
+	n.Mutes().AddChangeHandler(onlineMonitor.SyncMutes)
+	n.Mutes().AddChangeHandler(probeMonitor.SyncMutes)
+	n.SetUpdateHandler(commands.HandleUpdate)
+	n.SetCommands(commands.List())
 	n.InitBots(config.Complexes)
 
 	monitor.Restore()
 	onlineMonitor.Restore()
+	probeMonitor.Restore()
+	n.Mutes().Restore()
+	followUps.Restore()
 
 	ticker := time.NewTicker(time.Duration(config.ConfigRereadInterval) * time.Second)
 	stop := make(chan struct{})
@@ -81,6 +148,7 @@ func main() {
 				monitor.UpdateComplexes(parseComplexes())
 				n.InitBots(parseComplexes())
 				onlineMonitor.UpdateComplexes(parseComplexes())
+				probeMonitor.UpdateComplexes(parseComplexes())
 			case <-stop:
 				return
 			}
@@ -89,7 +157,7 @@ func main() {
 
 	r := gin.Default()
 	r.LoadHTMLGlob("templates/*")
-	keepAlive := make(chan os.Signal)
+	keepAlive := make(chan os.Signal, 1)
 	signal.Notify(keepAlive, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 
 	r.GET("/", func(c *gin.Context) {
@@ -103,6 +171,67 @@ func main() {
 	auth.GET("/online-status", func(c *gin.Context) {
 		c.JSON(200, onlineMonitor.GetStatus())
 	})
+	auth.GET("/probe-status", func(c *gin.Context) {
+		c.JSON(200, probeMonitor.GetStatus())
+	})
+	auth.GET("/bots", func(c *gin.Context) {
+		c.JSON(200, n.GetRegistrations())
+	})
+	auth.GET("/mutes", func(c *gin.Context) {
+		c.JSON(200, n.Mutes().List())
+	})
+	auth.GET("/mute", func(c *gin.Context) {
+		until, err := core.ParseMuteUntil(c.Query("until"), time.Now())
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if mac := c.Query("mac"); mac != "" {
+			device, ok := monitor.FindDevice(mac)
+
+			if !ok {
+				device, ok = onlineMonitor.FindDevice(mac)
+			}
+
+			if !ok {
+				device, ok = probeMonitor.FindDevice(mac)
+			}
+
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+				return
+			}
+
+			n.Mutes().MuteLine(device, until)
+		} else if key := c.Query("complex"); key != "" {
+			complexStruct, ok := core.ToMap(parseComplexes())[key]
+
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": "complex not found"})
+				return
+			}
+
+			n.Mutes().MuteComplex(complexStruct, until)
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mac or complex is required"})
+			return
+		}
+
+		c.JSON(200, n.Mutes().List())
+	})
+	auth.GET("/unmute", func(c *gin.Context) {
+		if mac := c.Query("mac"); mac != "" {
+			n.Mutes().UnmuteLine(mac)
+		}
+
+		if key := c.Query("complex"); key != "" {
+			n.Mutes().UnmuteComplex(key)
+		}
+
+		c.JSON(200, n.Mutes().List())
+	})
 	auth.GET("/update-notification", func(c *gin.Context) {
 		mac := c.Query("mac")
 		status := c.Query("status")
@@ -125,6 +254,20 @@ func main() {
 			return
 		}
 
+		if c.UsePolling {
+			context.JSON(http.StatusForbidden, gin.H{"error": "bot uses long polling"})
+
+			return
+		}
+
+		secret := context.GetHeader(secretTokenHeader)
+
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(c.SecretToken())) != 1 {
+			context.JSON(http.StatusUnauthorized, gin.H{"error": "secret token mismatch"})
+
+			return
+		}
+
 		bot, err := tgbotapi.NewBotAPI(c.BotToken)
 
 		if err != nil {
@@ -147,75 +290,169 @@ func main() {
 			return
 		}
 
-		if u.Message.IsCommand() {
-			msg := tgbotapi.NewMessage(u.Message.Chat.ID, "")
+		commands.HandleUpdate(c, bot, *u)
 
-			switch u.Message.Command() {
-			case "start":
-				msg.Text = "Вітаю!"
-				break
-			case "schedule":
+		context.JSON(http.StatusOK, gin.H{"error": "bot message nil"})
+	})
 
-			case "status":
-				var text string
-				if c.IsDirectWire {
-					text = onlineMonitor.GetStatusText(c)
-				} else {
-					text = monitor.GetStatusText(c)
-				}
+	r.Match([]string{http.MethodGet, http.MethodPost}, "/direct-wire", func(c *gin.Context) {
+		d, err := parseDevice(c)
 
-				if text == "" {
-					text = "Нічого не знайдено"
-				}
+		if err == nil {
+			err = router.Route(ingest.KindDirect, d)
+		}
 
-				msg.Text = text
-				break
-			default:
-				msg.Text = "Невідома команда. Спробуйте /status"
-			}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{"message": "ok"})
+	})
+
+	r.Match([]string{http.MethodGet, http.MethodPost}, "/timeout-wire", func(context *gin.Context) {
+		d, err := parseDevice(context)
 
-			_, _ = bot.Send(msg)
+		if err == nil {
+			err = router.Route(ingest.KindTimeout, d)
 		}
 
-		context.JSON(http.StatusOK, gin.H{"error": "bot message nil"})
+		if err != nil {
+			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		context.JSON(200, gin.H{"message": "ok"})
 	})
 
-	r.POST("/direct-wire", func(c *gin.Context) {
+	r.Match([]string{http.MethodGet, http.MethodPost}, "/hybrid-wire", func(c *gin.Context) {
 		d, err := parseDevice(c)
 
+		if err == nil {
+			err = router.Route(ingest.KindHybrid, d)
+		}
+
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		onlineMonitor.HandleDevice(d)
+		c.JSON(200, gin.H{"message": "ok"})
+	})
+
+	r.POST("/backfill", func(c *gin.Context) {
+		d, err := parseDevice(c)
+
+		if err == nil {
+			err = router.Backfill(d)
+		}
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
 		c.JSON(200, gin.H{"message": "ok"})
 	})
 
-	r.POST("/timeout-wire", func(context *gin.Context) {
-		d, err := parseDevice(context)
+	r.Match([]string{http.MethodGet, http.MethodPost}, "/shelly", func(c *gin.Context) {
+		b, err := c.GetRawData()
 
 		if err != nil {
-			context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		monitor.AddDevice(d)
+		d, err := ingest.ShellyDevice(c.Request.URL.Query(), b)
 
-		context.JSON(200, gin.H{"message": "ok"})
+		if err == nil {
+			err = router.Route(ingest.KindDirect, d)
+		}
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{"message": "ok"})
+	})
+
+	r.Match([]string{http.MethodGet, http.MethodPost}, "/tasmota", func(c *gin.Context) {
+		b, err := c.GetRawData()
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		d, err := ingest.TasmotaDevice(c.Request.URL.Query(), b)
+
+		if err == nil {
+			err = router.Route(ingest.KindDirect, d)
+		}
+
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{"message": "ok"})
 	})
 
 	go r.Run(config.HttpBind)
 	go n.Start()
+	go history.Start()
 
 	go monitor.Start()
+	go onlineMonitor.Start()
+
+	snapshots := time.NewTicker(time.Second * core.SnapshotInterval)
+	go func() {
+		for range snapshots.C {
+			monitor.Snapshot()
+			onlineMonitor.Snapshot()
+		}
+	}()
+
+	go probeMonitor.Start()
+	go n.Mutes().Start()
+	go followUps.Start()
+	webhooks.Start()
+	if publisher != nil {
+		publisher.Start()
+	}
+	if subscriber != nil {
+		subscriber.Start()
+	}
+	for _, client := range meshtasticClients {
+		go client.Start()
+	}
+	nutPoller.Start()
 
 	<-keepAlive
+	snapshots.Stop()
 	monitor.Stop()
+	onlineMonitor.Stop()
+	probeMonitor.Stop()
+	n.Mutes().Stop()
+	followUps.Stop()
+	webhooks.Stop()
+	if subscriber != nil {
+		subscriber.Stop()
+	}
+	for _, client := range meshtasticClients {
+		client.Stop()
+	}
+	udpListener.Stop()
+	nutPoller.Stop()
+	if publisher != nil {
+		publisher.Stop()
+	}
+	history.Stop()
 	n.Stop()
 	monitor.Backup()
 	onlineMonitor.Backup()
+	probeMonitor.Backup()
 	stop <- struct{}{}
 }
 
@@ -226,6 +463,11 @@ func parseDevice(c *gin.Context) (comunication.Device, error) {
 	if err != nil {
 		return d, err
 	}
+
+	if len(b) == 0 {
+		return ingest.DeviceFromQuery(c.Request.URL.Query())
+	}
+
 	err = json.Unmarshal(b, &d)
 	if err != nil {
 		return d, err
@@ -0,0 +1,170 @@
+package meshtastic
+
+import (
+	"encoding/json"
+	"go-meshtastic-monitor/comunication"
+	"go-meshtastic-monitor/ingest"
+	"strings"
+	"sync"
+	"time"
+)
+
+const KindMeshtastic = "meshtastic"
+const DefaultDedupWindow = 600
+
+type Node struct {
+	Id       string `json:"id" yaml:"id"`
+	Key      string `json:"key" yaml:"key"`
+	Name     string `json:"name" yaml:"name"`
+	Kind     string `json:"kind" yaml:"kind"`
+	Interval int64  `json:"interval" yaml:"interval"`
+}
+
+type MeshtasticConf struct {
+	Tcp         []string `json:"tcp" yaml:"tcp"`
+	DedupWindow int64    `json:"dedup_window_s" yaml:"dedup_window_s"`
+	Nodes       []Node   `json:"nodes" yaml:"nodes"`
+}
+
+// Adapter maps packets of configured nodes onto comunication.Device.
+// Any packet is a heartbeat for timeout lines, direct lines need device metrics or a text with the power state.
+type Adapter struct {
+	router *ingest.Router
+	nodes  map[string]Node
+	window time.Duration
+
+	rw   sync.Mutex
+	seen map[uint64]time.Time
+}
+
+func NewAdapter(conf MeshtasticConf, router *ingest.Router) *Adapter {
+	window := conf.DedupWindow
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+
+	a := &Adapter{
+		router: router,
+		nodes:  make(map[string]Node),
+		window: time.Duration(window) * time.Second,
+		seen:   make(map[uint64]time.Time),
+	}
+
+	for _, node := range conf.Nodes {
+		if node.Kind == "" {
+			node.Kind = ingest.KindTimeout
+		}
+
+		a.nodes[strings.ToLower(node.Id)] = node
+	}
+
+	return a
+}
+
+func (a *Adapter) HandleJSON(payload []byte) error {
+	p, err := ParseJSON(payload)
+
+	if err != nil {
+		return err
+	}
+
+	return a.HandlePacket(p)
+}
+
+func (a *Adapter) HandlePacket(p Packet) error {
+	node, ok := a.nodes[NodeId(p.From)]
+
+	if !ok {
+		return nil
+	}
+
+	if a.isDuplicate(p) {
+		return nil
+	}
+
+	d := comunication.Device{
+		Key:        node.Key,
+		Name:       node.Name,
+		MacAddress: node.Id,
+		Interval:   node.Interval,
+	}
+
+	if p.HasMetrics {
+		d.Telemetry = &comunication.Telemetry{
+			BatteryLevel: p.BatteryLevel,
+			Voltage:      p.Voltage,
+		}
+	}
+
+	if node.Kind == ingest.KindDirect || node.Kind == ingest.KindHybrid {
+		pluggedIn, known := p.IsExternallyPowered()
+
+		if p.Type == TypeText {
+			pluggedIn, known = parseTextPower(p.Text)
+		}
+
+		if !known {
+			return nil
+		}
+
+		d.HasDirectWire = true
+		d.IsPluggedIn = pluggedIn
+	}
+
+	return a.router.Route(node.Kind, d)
+}
+
+// isDuplicate drops copies of the same packet relayed by several nodes or received over MQTT and TCP.
+func (a *Adapter) isDuplicate(p Packet) bool {
+	if p.Id == 0 {
+		return false
+	}
+
+	a.rw.Lock()
+	defer a.rw.Unlock()
+
+	now := time.Now()
+	key := uint64(p.From)<<32 | uint64(p.Id)
+
+	if at, ok := a.seen[key]; ok && now.Sub(at) < a.window {
+		return true
+	}
+
+	a.seen[key] = now
+
+	if len(a.seen)%1000 == 0 {
+		for k, at := range a.seen {
+			if now.Sub(at) >= a.window {
+				delete(a.seen, k)
+			}
+		}
+	}
+
+	return false
+}
+
+// parseTextPower understands "on"/"off", "p=1"/"p=0" and the device JSON with the "p" field.
+func parseTextPower(text string) (bool, bool) {
+	text = strings.ToLower(strings.TrimSpace(text))
+
+	if strings.HasPrefix(text, "{") {
+		var payload struct {
+			IsPluggedIn *bool `json:"p"`
+		}
+
+		if json.Unmarshal([]byte(text), &payload) != nil || payload.IsPluggedIn == nil {
+			return false, false
+		}
+
+		return *payload.IsPluggedIn, true
+	}
+
+	switch strings.ReplaceAll(text, " ", "") {
+	case "on", "poweron", "p=1", "p:1", "p=true":
+		return true, true
+	case "off", "poweroff", "p=0", "p:0", "p=false":
+		return false, true
+	}
+
+	return false, false
+}
@@ -0,0 +1,107 @@
+package meshtastic
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const TypeTelemetry = "telemetry"
+const TypeText = "text"
+const TypeNodeInfo = "nodeinfo"
+const TypePosition = "position"
+const TypeOther = "other"
+
+// ExternalPowerLevel is the battery_level firmware reports while the node runs from external power.
+const ExternalPowerLevel = 101
+
+// Packet is the part of a mesh packet the monitor cares about, decoded from either gateway JSON or protobuf.
+type Packet struct {
+	Id           uint32
+	From         uint32
+	Type         string
+	Text         string
+	HasMetrics   bool
+	BatteryLevel uint32
+	Voltage      float64
+}
+
+type jsonPacket struct {
+	Id      uint32          `json:"id"`
+	From    uint32          `json:"from"`
+	Sender  string          `json:"sender"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type jsonPayload struct {
+	Text         string   `json:"text"`
+	BatteryLevel *uint32  `json:"battery_level"`
+	Voltage      *float64 `json:"voltage"`
+}
+
+func NodeId(num uint32) string {
+	return fmt.Sprintf("!%08x", num)
+}
+
+// IsExternallyPowered reports the power state when the packet carries device metrics.
+func (p Packet) IsExternallyPowered() (bool, bool) {
+	if !p.HasMetrics {
+		return false, false
+	}
+
+	return p.BatteryLevel >= ExternalPowerLevel, true
+}
+
+// ParseJSON decodes a packet published by a gateway with the MQTT "JSON output" option enabled.
+func ParseJSON(b []byte) (Packet, error) {
+	var raw jsonPacket
+	err := json.Unmarshal(b, &raw)
+
+	if err != nil {
+		return Packet{}, err
+	}
+
+	p := Packet{
+		Id:   raw.Id,
+		From: raw.From,
+		Type: raw.Type,
+	}
+
+	switch raw.Type {
+	case TypeTelemetry, TypeText, TypeNodeInfo, TypePosition:
+	default:
+		p.Type = TypeOther
+	}
+
+	if len(raw.Payload) == 0 {
+		return p, nil
+	}
+
+	if p.Type == TypeText {
+		// text payload is sometimes a plain string instead of an object
+		var text string
+		if json.Unmarshal(raw.Payload, &text) == nil {
+			p.Text = text
+
+			return p, nil
+		}
+	}
+
+	var payload jsonPayload
+	if json.Unmarshal(raw.Payload, &payload) != nil {
+		return p, nil
+	}
+
+	p.Text = payload.Text
+
+	if p.Type == TypeTelemetry && payload.BatteryLevel != nil {
+		p.HasMetrics = true
+		p.BatteryLevel = *payload.BatteryLevel
+	}
+
+	if payload.Voltage != nil {
+		p.Voltage = *payload.Voltage
+	}
+
+	return p, nil
+}
@@ -0,0 +1,203 @@
+package meshtastic
+
+import (
+	"math"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+
+	return protowire.AppendBytes(b, message)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+
+	return protowire.AppendVarint(b, v)
+}
+
+// fromRadio wraps a Data message (portnum and payload) into MeshPacket and FromRadio like the node sends it
+func fromRadio(from uint32, id uint32, portnum uint64, payload []byte) []byte {
+	var data []byte
+	data = appendVarint(data, dataPortnum, portnum)
+	data = appendMessage(data, dataPayload, payload)
+
+	var packet []byte
+	packet = appendVarint(packet, meshPacketFrom, uint64(from))
+	// MeshPacket.to is skipped by the decoder
+	packet = protowire.AppendTag(packet, 2, protowire.Fixed32Type)
+	packet = protowire.AppendFixed32(packet, 0xffffffff)
+	packet = appendMessage(packet, meshPacketDecoded, data)
+	packet = appendVarint(packet, meshPacketId, uint64(id))
+
+	var b []byte
+	b = appendVarint(b, 1, 42)
+
+	return appendMessage(b, fromRadioPacket, packet)
+}
+
+func deviceMetrics(batteryLevel uint64, voltage float32) []byte {
+	var metrics []byte
+	metrics = appendVarint(metrics, deviceMetricsBatteryLevel, batteryLevel)
+	metrics = protowire.AppendTag(metrics, deviceMetricsVoltage, protowire.Fixed32Type)
+	metrics = protowire.AppendFixed32(metrics, math.Float32bits(voltage))
+
+	var telemetry []byte
+	// Telemetry.time
+	telemetry = protowire.AppendTag(telemetry, 1, protowire.Fixed32Type)
+	telemetry = protowire.AppendFixed32(telemetry, 1700000000)
+
+	return appendMessage(telemetry, telemetryDeviceMetrics, metrics)
+}
+
+func TestParseFromRadio(t *testing.T) {
+	encrypted := appendVarint(nil, meshPacketFrom, 0x1234)
+	encrypted = appendMessage(encrypted, 5, []byte{0x01, 0x02, 0x03})
+
+	tests := []struct {
+		name      string
+		b         []byte
+		ok        bool
+		err       bool
+		want      Packet
+		pluggedIn bool
+		known     bool
+	}{
+		{
+			name:      "telemetry on external power",
+			b:         fromRadio(0xa1b2c3d4, 7, portTelemetry, deviceMetrics(101, 4.2)),
+			ok:        true,
+			want:      Packet{Id: 7, From: 0xa1b2c3d4, Type: TypeTelemetry, HasMetrics: true, BatteryLevel: 101, Voltage: float64(float32(4.2))},
+			pluggedIn: true,
+			known:     true,
+		},
+		{
+			name:  "telemetry on battery",
+			b:     fromRadio(0xa1b2c3d4, 8, portTelemetry, deviceMetrics(76, 3.9)),
+			ok:    true,
+			want:  Packet{Id: 8, From: 0xa1b2c3d4, Type: TypeTelemetry, HasMetrics: true, BatteryLevel: 76, Voltage: float64(float32(3.9))},
+			known: true,
+		},
+		{
+			name: "text",
+			b:    fromRadio(0x1234, 9, portTextMessage, []byte("p=1")),
+			ok:   true,
+			want: Packet{Id: 9, From: 0x1234, Type: TypeText, Text: "p=1"},
+		},
+		{
+			name: "node info",
+			b:    fromRadio(0x1234, 10, portNodeInfo, []byte{0x0a, 0x00}),
+			ok:   true,
+			want: Packet{Id: 10, From: 0x1234, Type: TypeNodeInfo},
+		},
+		{
+			name: "encrypted",
+			b:    appendMessage(nil, fromRadioPacket, encrypted),
+			want: Packet{From: 0x1234, Type: TypeOther},
+		},
+		{
+			name: "config",
+			b:    appendVarint(nil, 7, 42),
+		},
+		{
+			name: "truncated",
+			b:    fromRadio(0x1234, 11, portTextMessage, []byte("p=1"))[:12],
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok, err := ParseFromRadio(tt.b)
+
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v", err)
+			}
+
+			if ok != tt.ok || p != tt.want {
+				t.Fatalf("got %+v %v, want %+v %v", p, ok, tt.want, tt.ok)
+			}
+
+			pluggedIn, known := p.IsExternallyPowered()
+			if pluggedIn != tt.pluggedIn || known != tt.known {
+				t.Fatalf("externally powered %v %v, want %v %v", pluggedIn, known, tt.pluggedIn, tt.known)
+			}
+		})
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    Packet
+	}{
+		{
+			name:    "telemetry on external power",
+			payload: `{"channel":0,"from":2712847316,"id":1553461543,"payload":{"air_util_tx":0.12,"battery_level":101,"channel_utilization":3.5,"uptime_seconds":5100,"voltage":4.21},"sender":"!a1b2c3d4","timestamp":1700000000,"to":4294967295,"type":"telemetry"}`,
+			want:    Packet{Id: 1553461543, From: 2712847316, Type: TypeTelemetry, HasMetrics: true, BatteryLevel: 101, Voltage: 4.21},
+		},
+		{
+			name:    "environment telemetry",
+			payload: `{"from":2712847316,"id":1,"payload":{"temperature":21.5,"voltage":12.1},"type":"telemetry"}`,
+			want:    Packet{Id: 1, From: 2712847316, Type: TypeTelemetry, Voltage: 12.1},
+		},
+		{
+			name:    "text object",
+			payload: `{"from":4660,"id":2,"payload":{"text":"p=1"},"type":"text"}`,
+			want:    Packet{Id: 2, From: 4660, Type: TypeText, Text: "p=1"},
+		},
+		{
+			name:    "text string",
+			payload: `{"from":4660,"id":3,"payload":"off","type":"text"}`,
+			want:    Packet{Id: 3, From: 4660, Type: TypeText, Text: "off"},
+		},
+		{
+			name:    "unknown type",
+			payload: `{"from":4660,"id":4,"payload":{},"type":"neighborinfo"}`,
+			want:    Packet{Id: 4, From: 4660, Type: TypeOther},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseJSON([]byte(tt.payload))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if p != tt.want {
+				t.Fatalf("got %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTextPower(t *testing.T) {
+	tests := []struct {
+		text      string
+		pluggedIn bool
+		known     bool
+	}{
+		{"p=1", true, true},
+		{" P = 0 ", false, true},
+		{"on", true, true},
+		{"Power Off", false, true},
+		{`{"p":true}`, true, true},
+		{`{"p":false,"b":80}`, false, true},
+		{`{"b":80}`, false, false},
+		{"hello", false, false},
+	}
+
+	for _, tt := range tests {
+		pluggedIn, known := parseTextPower(tt.text)
+
+		if pluggedIn != tt.pluggedIn || known != tt.known {
+			t.Fatalf("%q: got %v %v, want %v %v", tt.text, pluggedIn, known, tt.pluggedIn, tt.known)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package meshtastic
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+)
+
+// Field numbers from meshtastic/protobufs (mesh.proto, portnums.proto, telemetry.proto).
+// Only the handful of fields needed for power monitoring are decoded by hand,
+// which keeps the generated protobuf package out of the build.
+const (
+	fromRadioPacket = 2
+
+	toRadioWantConfigId = 3
+	toRadioHeartbeat    = 7
+
+	meshPacketFrom    = 1
+	meshPacketDecoded = 4
+	meshPacketId      = 6
+
+	dataPortnum = 1
+	dataPayload = 2
+
+	telemetryDeviceMetrics = 2
+
+	deviceMetricsBatteryLevel = 1
+	deviceMetricsVoltage      = 2
+
+	portTextMessage = 1
+	portPosition    = 3
+	portNodeInfo    = 4
+	portTelemetry   = 67
+)
+
+type field struct {
+	num   protowire.Number
+	value uint64
+	bytes []byte
+}
+
+func parseFields(b []byte) ([]field, error) {
+	var fields []field
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := field{num: num}
+
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.value = uint64(v)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// ParseFromRadio decodes a FromRadio message, ok is false for anything except a decoded mesh packet.
+func ParseFromRadio(b []byte) (Packet, bool, error) {
+	fields, err := parseFields(b)
+
+	if err != nil {
+		return Packet{}, false, err
+	}
+
+	for _, f := range fields {
+		if f.num == fromRadioPacket {
+			return parseMeshPacket(f.bytes)
+		}
+	}
+
+	return Packet{}, false, nil
+}
+
+func parseMeshPacket(b []byte) (Packet, bool, error) {
+	fields, err := parseFields(b)
+
+	if err != nil {
+		return Packet{}, false, err
+	}
+
+	p := Packet{Type: TypeOther}
+	var data []byte
+
+	for _, f := range fields {
+		switch f.num {
+		case meshPacketFrom:
+			p.From = uint32(f.value)
+		case meshPacketId:
+			p.Id = uint32(f.value)
+		case meshPacketDecoded:
+			data = f.bytes
+		}
+	}
+
+	// encrypted packets for channels we do not have the key for
+	if data == nil {
+		return p, false, nil
+	}
+
+	fields, err = parseFields(data)
+
+	if err != nil {
+		return Packet{}, false, err
+	}
+
+	var portnum uint64
+	var payload []byte
+
+	for _, f := range fields {
+		switch f.num {
+		case dataPortnum:
+			portnum = f.value
+		case dataPayload:
+			payload = f.bytes
+		}
+	}
+
+	switch portnum {
+	case portTextMessage:
+		p.Type = TypeText
+		p.Text = string(payload)
+	case portPosition:
+		p.Type = TypePosition
+	case portNodeInfo:
+		p.Type = TypeNodeInfo
+	case portTelemetry:
+		p.Type = TypeTelemetry
+		err = parseTelemetry(payload, &p)
+	}
+
+	return p, err == nil, err
+}
+
+func parseTelemetry(b []byte, p *Packet) error {
+	fields, err := parseFields(b)
+
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		if f.num != telemetryDeviceMetrics {
+			continue
+		}
+
+		metrics, err := parseFields(f.bytes)
+
+		if err != nil {
+			return err
+		}
+
+		for _, m := range metrics {
+			switch m.num {
+			case deviceMetricsBatteryLevel:
+				p.HasMetrics = true
+				p.BatteryLevel = uint32(m.value)
+			case deviceMetricsVoltage:
+				p.Voltage = float64(math.Float32frombits(uint32(m.value)))
+			}
+		}
+	}
+
+	return nil
+}
+
+func wantConfig(id uint32) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, toRadioWantConfigId, protowire.VarintType)
+
+	return protowire.AppendVarint(b, uint64(id))
+}
+
+func heartbeat() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, toRadioHeartbeat, protowire.BytesType)
+
+	return protowire.AppendBytes(b, nil)
+}
@@ -0,0 +1,212 @@
+package meshtastic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const DefaultTcpPort = "4403"
+const frameStart1 = 0x94
+const frameStart2 = 0xc3
+const maxFrameSize = 512
+const heartbeatInterval = 5 * time.Minute
+const maxReconnectDelay = 2 * time.Minute
+
+var errFrameTooLarge = errors.New("meshtastic frame too large")
+
+// TcpClient reads packets from a node's TCP API (the protocol used by the Meshtastic apps on port 4403).
+type TcpClient struct {
+	address  string
+	adapter  *Adapter
+	stopChan chan struct{}
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func NewTcpClient(address string, adapter *Adapter) *TcpClient {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DefaultTcpPort)
+	}
+
+	return &TcpClient{
+		address:  address,
+		adapter:  adapter,
+		stopChan: make(chan struct{}),
+	}
+}
+
+func (c *TcpClient) Start() {
+	delay := time.Second
+
+	for {
+		started := time.Now()
+		err := c.session()
+
+		select {
+		case <-c.stopChan:
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Println("[MESHTASTIC]", c.address, err.Error())
+		}
+
+		if time.Since(started) > maxReconnectDelay {
+			delay = time.Second
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-c.stopChan:
+			return
+		}
+
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (c *TcpClient) Stop() {
+	close(c.stopChan)
+
+	c.lock.Lock()
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	c.lock.Unlock()
+}
+
+func (c *TcpClient) session() error {
+	conn, err := net.DialTimeout("tcp", c.address, 10*time.Second)
+
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.conn = conn
+	c.lock.Unlock()
+	defer conn.Close()
+
+	log.Println("[MESHTASTIC] connected to", c.address)
+
+	err = writeFrame(conn, wantConfig(rand.Uint32()))
+
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		t := time.NewTicker(heartbeatInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				if err := writeFrame(conn, heartbeat()); err != nil {
+					_ = conn.Close()
+
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+
+	for {
+		frame, err := readFrame(r)
+
+		if err != nil {
+			return err
+		}
+
+		p, ok, err := ParseFromRadio(frame)
+
+		if err != nil {
+			log.Println("[MESHTASTIC] failed to decode packet:", err.Error())
+
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err = c.adapter.HandlePacket(p); err != nil {
+			log.Println("[MESHTASTIC] rejected packet from", NodeId(p.From), err.Error())
+		}
+	}
+}
+
+func writeFrame(w io.Writer, payload []byte) error {
+	header := []byte{frameStart1, frameStart2, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+
+	_, err := w.Write(append(header, payload...))
+
+	return err
+}
+
+// readFrame skips debug output the firmware interleaves with frames until the next frame header.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.ReadByte()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if b != frameStart1 {
+			continue
+		}
+
+		b, err = r.ReadByte()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if b != frameStart2 {
+			_ = r.UnreadByte()
+
+			continue
+		}
+
+		header := make([]byte, 2)
+		if _, err = io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+
+		size := binary.BigEndian.Uint16(header)
+
+		if size > maxFrameSize {
+			log.Println("[MESHTASTIC]", errFrameTooLarge.Error(), size)
+
+			continue
+		}
+
+		frame := make([]byte, size)
+		if _, err = io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+
+		return frame, nil
+	}
+}
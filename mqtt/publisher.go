@@ -0,0 +1,257 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"go-meshtastic-monitor/core"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const DefaultTopicPrefix = "power-monitor"
+const DefaultDiscoveryPrefix = "homeassistant"
+const PayloadOn = "ON"
+const PayloadOff = "OFF"
+const PayloadUnknown = "None" // resets a Home Assistant binary sensor to unknown
+const PayloadOnline = "online"
+const PayloadOffline = "offline"
+
+var unsafeTopicChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+type MqttConf struct {
+	Broker          string         `json:"broker" yaml:"broker"`
+	ClientId        string         `json:"client_id" yaml:"client_id"`
+	Username        string         `json:"username" yaml:"username"`
+	Password        string         `json:"password" yaml:"password"`
+	TopicPrefix     string         `json:"topic_prefix" yaml:"topic_prefix"`
+	Discovery       bool           `json:"discovery" yaml:"discovery"`
+	DiscoveryPrefix string         `json:"discovery_prefix" yaml:"discovery_prefix"`
+	Subscriptions   []Subscription `json:"subscriptions" yaml:"subscriptions"`
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+type discoveryConfig struct {
+	Name                string          `json:"name"`
+	UniqueId            string          `json:"unique_id"`
+	StateTopic          string          `json:"state_topic"`
+	JsonAttributesTopic string          `json:"json_attributes_topic"`
+	AvailabilityTopic   string          `json:"availability_topic"`
+	PayloadOn           string          `json:"payload_on"`
+	PayloadOff          string          `json:"payload_off"`
+	DeviceClass         string          `json:"device_class"`
+	Device              discoveryDevice `json:"device"`
+}
+
+type lineAttributes struct {
+	Complex                      string    `json:"complex"`
+	Line                         string    `json:"line"`
+	MacAddress                   string    `json:"mac"`
+	Since                        time.Time `json:"since"`
+	PreviousState                string    `json:"previous_state"`
+	PreviousStateDurationSeconds int64     `json:"previous_state_duration_s"`
+}
+
+// Publisher keeps a retained MQTT message with the state of every line and announces lines to Home Assistant.
+type Publisher struct {
+	conf   MqttConf
+	client paho.Client
+
+	rw    sync.Mutex
+	lines map[string]core.Transition
+}
+
+func NewPublisher(conf MqttConf) *Publisher {
+	if conf.TopicPrefix == "" {
+		conf.TopicPrefix = DefaultTopicPrefix
+	}
+
+	if conf.DiscoveryPrefix == "" {
+		conf.DiscoveryPrefix = DefaultDiscoveryPrefix
+	}
+
+	p := &Publisher{
+		conf:  conf,
+		lines: make(map[string]core.Transition),
+	}
+
+	opts := NewClientOptions(conf, "publisher")
+	opts.SetWill(p.availabilityTopic(), PayloadOffline, 1, true)
+	opts.SetOnConnectHandler(p.onConnect)
+	p.client = paho.NewClient(opts)
+
+	return p
+}
+
+// NewClientOptions returns options with automatic reconnect and exponential backoff up to two minutes.
+func NewClientOptions(conf MqttConf, role string) *paho.ClientOptions {
+	clientId := conf.ClientId
+	if clientId == "" {
+		clientId = DefaultTopicPrefix
+	}
+
+	opts := paho.NewClientOptions()
+	opts.AddBroker(conf.Broker)
+	opts.SetClientID(clientId + "-" + role)
+	opts.SetUsername(conf.Username)
+	opts.SetPassword(conf.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetMaxReconnectInterval(2 * time.Minute)
+	opts.SetConnectionLostHandler(func(client paho.Client, err error) {
+		log.Println("[MQTT] connection lost:", role, err.Error())
+	})
+
+	return opts
+}
+
+func (p *Publisher) Start() {
+	p.client.Connect()
+}
+
+func (p *Publisher) Stop() {
+	p.wait(p.client.Publish(p.availabilityTopic(), 1, true, PayloadOffline))
+	p.client.Disconnect(1000)
+}
+
+func (p *Publisher) HandleTransition(t core.Transition) {
+	p.rw.Lock()
+	last, known := p.lines[t.MacAddress]
+
+	// a backfilled transition older than the published state would overwrite the retained state
+	if known && last.At.After(t.At) {
+		p.rw.Unlock()
+
+		return
+	}
+
+	p.lines[t.MacAddress] = t
+	p.rw.Unlock()
+
+	if !known {
+		p.publishDiscovery(t)
+	}
+
+	p.publishState(t)
+}
+
+// onConnect restores availability and everything published before the connection was lost.
+func (p *Publisher) onConnect(client paho.Client) {
+	log.Println("[MQTT] publisher connected to", p.conf.Broker)
+
+	go func() {
+		p.wait(client.Publish(p.availabilityTopic(), 1, true, PayloadOnline))
+
+		p.rw.Lock()
+		var lines []core.Transition
+		for _, t := range p.lines {
+			lines = append(lines, t)
+		}
+		p.rw.Unlock()
+
+		for _, t := range lines {
+			p.publishDiscovery(t)
+			p.publishState(t)
+		}
+	}()
+}
+
+func (p *Publisher) publishState(t core.Transition) {
+	payload := PayloadOff
+	if t.State == core.StateOn {
+		payload = PayloadOn
+	} else if t.State == core.StateUnreachable {
+		payload = PayloadUnknown
+	}
+
+	attributes, err := json.Marshal(lineAttributes{
+		Complex:                      t.ComplexName,
+		Line:                         t.DeviceName,
+		MacAddress:                   t.MacAddress,
+		Since:                        t.At,
+		PreviousState:                t.From,
+		PreviousStateDurationSeconds: int64(t.PreviousDuration().Seconds()),
+	})
+
+	if err != nil {
+		log.Println("[MQTT] failed to marshal attributes:", err.Error())
+
+		return
+	}
+
+	p.publish(p.lineTopic(t, "state"), payload)
+	p.publish(p.lineTopic(t, "attributes"), string(attributes))
+}
+
+func (p *Publisher) publishDiscovery(t core.Transition) {
+	if !p.conf.Discovery {
+		return
+	}
+
+	config, err := json.Marshal(discoveryConfig{
+		Name:                t.DeviceName,
+		UniqueId:            p.objectId(t),
+		StateTopic:          p.lineTopic(t, "state"),
+		JsonAttributesTopic: p.lineTopic(t, "attributes"),
+		AvailabilityTopic:   p.availabilityTopic(),
+		PayloadOn:           PayloadOn,
+		PayloadOff:          PayloadOff,
+		DeviceClass:         "power",
+		Device: discoveryDevice{
+			Identifiers:  []string{p.conf.TopicPrefix + "_" + sanitize(t.ComplexKey)},
+			Name:         t.ComplexName,
+			Manufacturer: "power-monitoring",
+		},
+	})
+
+	if err != nil {
+		log.Println("[MQTT] failed to marshal discovery config:", err.Error())
+
+		return
+	}
+
+	topic := fmt.Sprintf("%s/binary_sensor/%s/%s/config", p.conf.DiscoveryPrefix, sanitize(p.conf.TopicPrefix), p.objectId(t))
+	p.publish(topic, string(config))
+}
+
+func (p *Publisher) publish(topic string, payload string) {
+	token := p.client.Publish(topic, 1, true, payload)
+
+	go p.wait(token)
+}
+
+func (p *Publisher) wait(token paho.Token) {
+	if !token.WaitTimeout(10 * time.Second) {
+		log.Println("[MQTT] publish timeout")
+
+		return
+	}
+
+	if token.Error() != nil {
+		log.Println("[MQTT] publish failed:", token.Error().Error())
+	}
+}
+
+func (p *Publisher) lineTopic(t core.Transition, suffix string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", p.conf.TopicPrefix, sanitize(t.ComplexKey), sanitize(t.MacAddress), suffix)
+}
+
+func (p *Publisher) availabilityTopic() string {
+	return p.conf.TopicPrefix + "/status"
+}
+
+func (p *Publisher) objectId(t core.Transition) string {
+	return sanitize(t.ComplexKey + "_" + t.MacAddress)
+}
+
+func sanitize(value string) string {
+	return unsafeTopicChars.ReplaceAllString(value, "_")
+}
@@ -0,0 +1,86 @@
+package mqtt
+
+import (
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"go-meshtastic-monitor/ingest"
+	"log"
+	"time"
+)
+
+type Subscription struct {
+	Topic string `json:"topic" yaml:"topic"`
+	Kind  string `json:"kind" yaml:"kind"`
+	Qos   byte   `json:"qos" yaml:"qos"`
+}
+
+type Handler func(payload []byte) error
+
+// Subscriber accepts the same device JSON as the HTTP routes from MQTT topics,
+// other payload formats are plugged in with AddHandler.
+type Subscriber struct {
+	conf     MqttConf
+	client   paho.Client
+	handlers map[string]Handler
+}
+
+func NewSubscriber(conf MqttConf, router *ingest.Router) *Subscriber {
+	s := &Subscriber{
+		conf:     conf,
+		handlers: make(map[string]Handler),
+	}
+
+	for _, kind := range []string{ingest.KindDirect, ingest.KindTimeout, ingest.KindHybrid} {
+		kind := kind
+		s.AddHandler(kind, func(payload []byte) error {
+			return router.RouteJSON(kind, payload)
+		})
+	}
+
+	opts := NewClientOptions(conf, "subscriber")
+	opts.SetOnConnectHandler(s.onConnect)
+	s.client = paho.NewClient(opts)
+
+	return s
+}
+
+// AddHandler must be called before Start.
+func (s *Subscriber) AddHandler(kind string, handler Handler) {
+	s.handlers[kind] = handler
+}
+
+func (s *Subscriber) Start() {
+	s.client.Connect()
+}
+
+func (s *Subscriber) Stop() {
+	s.client.Disconnect(1000)
+}
+
+// onConnect subscribes again after every reconnect, the session is not persisted by the broker.
+func (s *Subscriber) onConnect(client paho.Client) {
+	log.Println("[MQTT] subscriber connected to", s.conf.Broker)
+
+	for _, subscription := range s.conf.Subscriptions {
+		handler, ok := s.handlers[subscription.Kind]
+
+		if !ok {
+			log.Println("[MQTT] unknown subscription kind", subscription.Kind, "for", subscription.Topic)
+
+			continue
+		}
+
+		token := client.Subscribe(subscription.Topic, subscription.Qos, func(client paho.Client, message paho.Message) {
+			err := handler(message.Payload())
+
+			if err != nil {
+				log.Println("[MQTT] rejected message from", message.Topic(), err.Error())
+			}
+		})
+
+		go func(topic string) {
+			if !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+				log.Println("[MQTT] failed to subscribe", topic, token.Error())
+			}
+		}(subscription.Topic)
+	}
+}
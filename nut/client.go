@@ -0,0 +1,134 @@
+package nut
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const DefaultPort = "3493"
+
+// Client speaks the small part of the upsd network protocol needed to read variables.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func Dial(address string, timeout time.Duration) (*Client, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DefaultPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	return &Client{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *Client) Close() error {
+	_, _ = c.command("LOGOUT")
+
+	return c.conn.Close()
+}
+
+func (c *Client) Login(username string, password string) error {
+	if username == "" {
+		return nil
+	}
+
+	for _, cmd := range []string{"USERNAME " + username, "PASSWORD " + password} {
+		line, err := c.command(cmd)
+
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(line, "OK") {
+			return errors.New("unexpected answer " + line)
+		}
+	}
+
+	return nil
+}
+
+// ListVars returns all variables of the ups, e.g. "ups.status" => "OL CHRG".
+func (c *Client) ListVars(ups string) (map[string]string, error) {
+	line, err := c.command("LIST VAR " + ups)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if line != "BEGIN LIST VAR "+ups {
+		return nil, errors.New("unexpected answer " + line)
+	}
+
+	vars := make(map[string]string)
+	prefix := "VAR " + ups + " "
+
+	for {
+		line, err = c.readLine()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if line == "END LIST VAR "+ups {
+			return vars, nil
+		}
+
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, prefix), " ")
+
+		if !ok {
+			continue
+		}
+
+		vars[name] = unquote(value)
+	}
+}
+
+func (c *Client) command(cmd string) (string, error) {
+	_, err := fmt.Fprintf(c.conn, "%s\n", cmd)
+
+	if err != nil {
+		return "", err
+	}
+
+	return c.readLine()
+}
+
+func (c *Client) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+
+	if err != nil {
+		return "", err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+
+	if strings.HasPrefix(line, "ERR ") {
+		return "", errors.New(line)
+	}
+
+	return line, nil
+}
+
+func unquote(value string) string {
+	value = strings.TrimSpace(value)
+	value = strings.TrimPrefix(value, `"`)
+	value = strings.TrimSuffix(value, `"`)
+
+	return strings.ReplaceAll(strings.ReplaceAll(value, `\"`, `"`), `\\`, `\`)
+}
@@ -0,0 +1,185 @@
+package nut
+
+import (
+	"fmt"
+	"go-meshtastic-monitor/comunication"
+	"go-meshtastic-monitor/core"
+	"go-meshtastic-monitor/ingest"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultInterval = 30
+const DefaultTimeout = 10
+
+type Ups struct {
+	Name string `json:"name" yaml:"name"`
+	Key  string `json:"key" yaml:"key"`
+	Line string `json:"line" yaml:"line"`
+	Id   string `json:"id" yaml:"id"`
+}
+
+type Server struct {
+	Address  string `json:"address" yaml:"address"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+	Interval int64  `json:"interval" yaml:"interval"`
+	Ups      []Ups  `json:"ups" yaml:"ups"`
+}
+
+// Poller reads ups.status from upsd instances and reports every UPS as a direct wire line:
+// OL means the line has power, OB means it runs from battery.
+type Poller struct {
+	servers  []Server
+	router   *ingest.Router
+	alert    func(key string, message string)
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+
+	rw         sync.Mutex
+	lowBattery map[string]bool
+}
+
+func NewPoller(servers []Server, router *ingest.Router, notifier *core.Notifier) *Poller {
+	return &Poller{
+		servers: servers,
+		router:  router,
+		alert: func(key string, message string) {
+			notifier.Alert(comunication.Complex{}, key, message)
+		},
+		stopChan:   make(chan struct{}),
+		lowBattery: make(map[string]bool),
+	}
+}
+
+func UpsId(server Server, ups Ups) string {
+	if ups.Id != "" {
+		return ups.Id
+	}
+
+	return "nut:" + ups.Name + "@" + server.Address
+}
+
+func (p *Poller) Start() {
+	for _, server := range p.servers {
+		p.wg.Add(1)
+		go p.run(server)
+	}
+}
+
+func (p *Poller) Stop() {
+	close(p.stopChan)
+	p.wg.Wait()
+}
+
+func (p *Poller) run(server Server) {
+	defer p.wg.Done()
+
+	interval := server.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	t := time.NewTicker(time.Duration(interval) * time.Second)
+	defer t.Stop()
+
+	p.poll(server)
+
+	for {
+		select {
+		case <-t.C:
+			p.poll(server)
+		case <-p.stopChan:
+			return
+		}
+	}
+}
+
+func (p *Poller) poll(server Server) {
+	client, err := Dial(server.Address, DefaultTimeout*time.Second)
+
+	if err != nil {
+		log.Println("[NUT]", server.Address, err.Error())
+
+		return
+	}
+	defer client.Close()
+
+	err = client.Login(server.Username, server.Password)
+
+	if err != nil {
+		log.Println("[NUT] login failed", server.Address, err.Error())
+
+		return
+	}
+
+	for _, ups := range server.Ups {
+		vars, err := client.ListVars(ups.Name)
+
+		if err != nil {
+			log.Println("[NUT]", ups.Name, server.Address, err.Error())
+
+			continue
+		}
+
+		p.handle(server, ups, vars)
+	}
+}
+
+func (p *Poller) handle(server Server, ups Ups, vars map[string]string) {
+	status := strings.Fields(vars["ups.status"])
+	flags := make(map[string]bool)
+	for _, flag := range status {
+		flags[flag] = true
+	}
+
+	// OFF, bypass or stale data do not tell anything about the grid
+	if !flags["OL"] && !flags["OB"] {
+		return
+	}
+
+	id := UpsId(server, ups)
+	interval := server.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	telemetry := &comunication.Telemetry{
+		UpsStatus:  vars["ups.status"],
+		LowBattery: flags["LB"],
+	}
+
+	if charge, err := strconv.ParseFloat(vars["battery.charge"], 64); err == nil {
+		telemetry.BatteryLevel = uint32(charge)
+	}
+
+	if runtime, err := strconv.ParseFloat(vars["battery.runtime"], 64); err == nil {
+		telemetry.BatteryRuntime = int64(runtime)
+	}
+
+	err := p.router.Route(ingest.KindDirect, comunication.Device{
+		Key:           ups.Key,
+		Name:          ups.Line,
+		MacAddress:    id,
+		Interval:      interval,
+		HasDirectWire: true,
+		IsPluggedIn:   flags["OL"] && !flags["OB"],
+		Telemetry:     telemetry,
+	})
+
+	if err != nil {
+		log.Println("[NUT]", id, err.Error())
+	}
+
+	p.rw.Lock()
+	wasLow := p.lowBattery[id]
+	p.lowBattery[id] = flags["LB"]
+	p.rw.Unlock()
+
+	if flags["LB"] && !wasLow {
+		p.alert("ups_low_battery:"+id, fmt.Sprintf("ДБЖ \"%s\" (%s): низький заряд батареї %d%%, залишилось %s", ups.Line, id, telemetry.BatteryLevel, (time.Duration(telemetry.BatteryRuntime)*time.Second).String()))
+	}
+}
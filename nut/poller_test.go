@@ -0,0 +1,242 @@
+package nut
+
+import (
+	"bufio"
+	"fmt"
+	"go-meshtastic-monitor/comunication"
+	"go-meshtastic-monitor/core"
+	"go-meshtastic-monitor/direct_wire"
+	"go-meshtastic-monitor/ingest"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeUpsd answers LIST VAR and GET VAR for one ups like upsd does, stale makes it report ERR DATA-STALE.
+type fakeUpsd struct {
+	listener net.Listener
+
+	rw    sync.Mutex
+	vars  map[string]string
+	stale bool
+}
+
+func newFakeUpsd(t *testing.T, address string) *fakeUpsd {
+	listener, err := net.Listen("tcp", address)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &fakeUpsd{listener: listener, vars: make(map[string]string)}
+	go u.serve()
+
+	return u
+}
+
+func (u *fakeUpsd) set(name string, value string) {
+	u.rw.Lock()
+	defer u.rw.Unlock()
+	u.vars[name] = value
+}
+
+func (u *fakeUpsd) setStale(stale bool) {
+	u.rw.Lock()
+	defer u.rw.Unlock()
+	u.stale = stale
+}
+
+func (u *fakeUpsd) serve() {
+	for {
+		conn, err := u.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go u.handle(conn)
+	}
+}
+
+func (u *fakeUpsd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		u.rw.Lock()
+		switch {
+		case fields[0] == "USERNAME" || fields[0] == "PASSWORD":
+			fmt.Fprint(conn, "OK\n")
+		case fields[0] == "LOGOUT":
+			fmt.Fprint(conn, "OK Goodbye\n")
+			u.rw.Unlock()
+
+			return
+		case len(fields) == 3 && fields[0] == "LIST" && fields[1] == "VAR":
+			if u.stale {
+				fmt.Fprint(conn, "ERR DATA-STALE\n")
+				break
+			}
+
+			fmt.Fprintf(conn, "BEGIN LIST VAR %s\n", fields[2])
+			for name, value := range u.vars {
+				fmt.Fprintf(conn, "VAR %s %s \"%s\"\n", fields[2], name, value)
+			}
+			fmt.Fprintf(conn, "END LIST VAR %s\n", fields[2])
+		case len(fields) == 4 && fields[0] == "GET" && fields[1] == "VAR":
+			value, ok := u.vars[fields[3]]
+
+			if u.stale {
+				fmt.Fprint(conn, "ERR DATA-STALE\n")
+			} else if !ok {
+				fmt.Fprint(conn, "ERR VAR-NOT-SUPPORTED\n")
+			} else {
+				fmt.Fprintf(conn, "VAR %s %s \"%s\"\n", fields[2], fields[3], value)
+			}
+		default:
+			fmt.Fprint(conn, "ERR UNKNOWN-COMMAND\n")
+		}
+		u.rw.Unlock()
+	}
+}
+
+type transitions struct {
+	rw    sync.Mutex
+	items []core.Transition
+}
+
+func (h *transitions) HandleTransition(t core.Transition) {
+	h.rw.Lock()
+	defer h.rw.Unlock()
+	h.items = append(h.items, t)
+}
+
+func (h *transitions) states() []string {
+	h.rw.Lock()
+	defer h.rw.Unlock()
+
+	var states []string
+	for _, t := range h.items {
+		states = append(states, t.State)
+	}
+
+	return states
+}
+
+func newTestPoller(address string) (*Poller, Server, *transitions, *[]string) {
+	notifier := core.NewNotifier("", core.OperatorConf{}, nil)
+	handler := &transitions{}
+	notifier.AddTransitionHandler(handler)
+
+	complexes := []comunication.Complex{{Key: "k", Name: "Дім"}}
+	router := ingest.NewRouter(nil, direct_wire.NewDirectWireMonitor(notifier, complexes, nil))
+
+	server := Server{
+		Address:  address,
+		Username: "monitor",
+		Password: "secret",
+		Ups:      []Ups{{Name: "ups", Key: "k", Line: "Квартира"}},
+	}
+
+	var alerts []string
+	p := NewPoller([]Server{server}, router, notifier)
+	p.alert = func(key string, message string) {
+		alerts = append(alerts, key)
+	}
+
+	return p, server, handler, &alerts
+}
+
+func TestPollerFollowsUpsStatus(t *testing.T) {
+	upsd := newFakeUpsd(t, "127.0.0.1:0")
+	defer upsd.listener.Close()
+
+	p, server, handler, alerts := newTestPoller(upsd.listener.Addr().String())
+
+	upsd.set("ups.status", "OL CHRG")
+	upsd.set("battery.charge", "100")
+	p.poll(server)
+
+	upsd.set("ups.status", "OB DISCHRG")
+	upsd.set("battery.charge", "80")
+	p.poll(server)
+
+	upsd.set("ups.status", "OB DISCHRG LB")
+	upsd.set("battery.charge", "10")
+	upsd.set("battery.runtime", "120")
+	p.poll(server)
+	p.poll(server)
+
+	if got := strings.Join(handler.states(), ","); got != "on,off" {
+		t.Fatalf("transitions %s, want on,off", got)
+	}
+
+	id := UpsId(server, server.Ups[0])
+	if len(*alerts) != 1 || (*alerts)[0] != "ups_low_battery:"+id {
+		t.Fatalf("alerts %v, want one low battery alert", *alerts)
+	}
+}
+
+func TestPollerSkipsOffAndStaleData(t *testing.T) {
+	upsd := newFakeUpsd(t, "127.0.0.1:0")
+	defer upsd.listener.Close()
+
+	p, server, handler, _ := newTestPoller(upsd.listener.Addr().String())
+
+	upsd.set("ups.status", "OL")
+	p.poll(server)
+
+	upsd.set("ups.status", "OFF")
+	p.poll(server)
+
+	upsd.set("ups.status", "OB")
+	upsd.setStale(true)
+	p.poll(server)
+
+	if got := strings.Join(handler.states(), ","); got != "on" {
+		t.Fatalf("transitions %s, want on", got)
+	}
+
+	upsd.setStale(false)
+	p.poll(server)
+
+	if got := strings.Join(handler.states(), ","); got != "on,off" {
+		t.Fatalf("transitions %s, want on,off", got)
+	}
+}
+
+func TestPollerReconnects(t *testing.T) {
+	upsd := newFakeUpsd(t, "127.0.0.1:0")
+	address := upsd.listener.Addr().String()
+
+	p, server, handler, _ := newTestPoller(address)
+
+	upsd.set("ups.status", "OL")
+	p.poll(server)
+
+	// upsd restarts, the poll while it is down is skipped and the next one dials again
+	upsd.listener.Close()
+	p.poll(server)
+
+	upsd = newFakeUpsd(t, address)
+	defer upsd.listener.Close()
+
+	upsd.set("ups.status", "OB")
+	p.poll(server)
+
+	if got := strings.Join(handler.states(), ","); got != "on,off" {
+		t.Fatalf("transitions %s, want on,off", got)
+	}
+}
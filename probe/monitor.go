@@ -0,0 +1,363 @@
+package probe
+
+import (
+	"encoding/json"
+	"go-meshtastic-monitor/comunication"
+	"go-meshtastic-monitor/core"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DevicesBackupKey = `backup_probe_devices`
+const DefaultInterval = 60
+const DefaultFailures = 3
+const DefaultTimeout = 5
+
+type line struct {
+	probe      comunication.Probe
+	complexKey string
+	nextAt     time.Time
+	running    bool
+	failures   int
+	failedAt   time.Time
+}
+
+// ProbeMonitor watches lines without a reporting device by connecting to hosts that die with the power.
+// A line is on while at least one of its targets answers and off after the configured number
+// of consecutive rounds where none did.
+type ProbeMonitor struct {
+	devices   map[string]comunication.Device
+	complexes map[string]comunication.Complex
+	lines     map[string]*line
+
+	rw       sync.RWMutex
+	notifier *core.Notifier
+	storage  *core.RedisStorage
+	stopChan chan struct{}
+}
+
+func NewProbeMonitor(notifier *core.Notifier, complexes []comunication.Complex, storage *core.RedisStorage) *ProbeMonitor {
+	m := &ProbeMonitor{
+		devices:  make(map[string]comunication.Device),
+		lines:    make(map[string]*line),
+		notifier: notifier,
+		storage:  storage,
+		stopChan: make(chan struct{}),
+	}
+	m.UpdateComplexes(complexes)
+
+	return m
+}
+
+func ProbeId(c comunication.Complex, p comunication.Probe) string {
+	if p.Id != "" {
+		return p.Id
+	}
+
+	return c.Key + ":" + p.Name
+}
+
+// SyncMutes applies a mute change to the lines at once instead of waiting for their next probe
+func (m *ProbeMonitor) SyncMutes() {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	now := time.Now()
+
+	for id, device := range m.devices {
+		if m.notifier.SyncMute(&device, now) {
+			m.devices[id] = device
+		}
+	}
+}
+
+func (m *ProbeMonitor) UpdateComplexes(complexes []comunication.Complex) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	m.complexes = core.ToMap(complexes)
+	lines := make(map[string]*line)
+
+	for _, c := range complexes {
+		for _, p := range c.Probes {
+			if p.Interval <= 0 {
+				p.Interval = DefaultInterval
+			}
+
+			if p.Failures <= 0 {
+				p.Failures = DefaultFailures
+			}
+
+			if p.Timeout <= 0 {
+				p.Timeout = DefaultTimeout
+			}
+
+			id := ProbeId(c, p)
+			l, ok := m.lines[id]
+
+			if !ok {
+				l = &line{}
+			}
+
+			l.probe = p
+			l.complexKey = c.Key
+			lines[id] = l
+		}
+	}
+
+	m.lines = lines
+
+	for id := range m.devices {
+		if _, ok := m.lines[id]; !ok {
+			delete(m.devices, id)
+		}
+	}
+}
+
+func (m *ProbeMonitor) Restore() {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	data, err := m.storage.Get(DevicesBackupKey)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to restore data from storage:", err.Error())
+
+		return
+	}
+
+	for _, device := range core.DecodeDevices(data) {
+		if device.Line.State == "" && device.IsPluggedIn {
+			device.Line = comunication.RestoredLine(comunication.LineOn, device.PowerOnAt)
+		} else if device.Line.State == "" {
+			device.Line = comunication.RestoredLine(comunication.LineOff, device.PowerOffAt)
+		}
+
+		if _, ok := m.lines[device.MacAddress]; ok {
+			m.devices[device.MacAddress] = device
+		}
+	}
+}
+
+func (m *ProbeMonitor) Backup() {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	if len(m.devices) == 0 {
+		log.Println("[INFO] No devices to backup")
+		return
+	}
+
+	var devices []comunication.Device
+	for _, device := range m.devices {
+		devices = append(devices, device)
+	}
+
+	b, err := json.Marshal(devices)
+
+	if err != nil {
+		log.Println("Error marshalling devices:", err.Error())
+
+		return
+	}
+
+	err = m.storage.Store(DevicesBackupKey, string(b))
+	if err != nil {
+		log.Println("Error storing devices:", err.Error())
+
+		return
+	}
+
+	log.Println("[INFO] Backup complete")
+}
+
+func (m *ProbeMonitor) Start() {
+	t := time.NewTicker(time.Second)
+
+	for {
+		select {
+		case now := <-t.C:
+			m.schedule(now)
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+func (m *ProbeMonitor) Stop() {
+	m.stopChan <- struct{}{}
+}
+
+func (m *ProbeMonitor) schedule(now time.Time) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	for id, l := range m.lines {
+		if l.running || now.Before(l.nextAt) {
+			continue
+		}
+
+		l.running = true
+		l.nextAt = now.Add(time.Duration(l.probe.Interval) * time.Second)
+
+		go func(id string, p comunication.Probe) {
+			ok := probeTargets(p)
+			m.handleResult(id, ok, time.Now())
+		}(id, l.probe)
+	}
+}
+
+func (m *ProbeMonitor) handleResult(id string, ok bool, now time.Time) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+
+	l, exist := m.lines[id]
+
+	if !exist {
+		return
+	}
+
+	l.running = false
+	c, exist := m.complexes[l.complexKey]
+
+	if !exist {
+		return
+	}
+
+	device, known := m.devices[id]
+	device.Name = l.probe.Name
+	device.Key = c.Key
+	device.MacAddress = id
+	device.Interval = l.probe.Interval
+	device.HasDirectWire = true
+	device.NotificationEnabled = true
+	device.Complex = c
+
+	input := comunication.InputPowerOn
+	at := now
+
+	if ok {
+		l.failures = 0
+		device.LastSeen = now
+	} else {
+		if l.failures == 0 {
+			l.failedAt = now
+		}
+		l.failures++
+
+		if l.failures < l.probe.Failures {
+			return
+		}
+
+		input = comunication.InputPowerOff
+		at = l.failedAt
+	}
+
+	if !known {
+		device.Line = comunication.NewLine()
+	}
+
+	event, changed := m.notifier.ApplyLine(&device, input, at)
+
+	if !changed {
+		m.devices[id] = device
+
+		return
+	}
+
+	var message string
+	if event.To == comunication.LineOn {
+		message = device.GeneratePowerOnMessageOnline()
+		device.IsPluggedIn = true
+		device.PowerOnAt = at
+	} else {
+		message = device.GeneratePowerOffMessage()
+		device.IsPluggedIn = false
+		device.PowerOffAt = at
+	}
+
+	m.devices[id] = device
+	m.notifier.Transition(core.NewLineTransition(device, event))
+
+	if event.ShouldNotify() {
+		m.notifier.Notify(core.Notification{
+			Device:  device,
+			Message: message,
+		})
+	}
+}
+
+// probeTargets succeeds when any target accepts a TCP connection or answers an HTTP request with any status.
+func probeTargets(p comunication.Probe) bool {
+	timeout := time.Duration(p.Timeout) * time.Second
+
+	for _, target := range p.Targets {
+		var err error
+
+		if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+			var resp *http.Response
+			resp, err = (&http.Client{Timeout: timeout}).Get(target)
+
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+		} else {
+			var conn net.Conn
+			conn, err = net.DialTimeout("tcp", target, timeout)
+
+			if err == nil {
+				_ = conn.Close()
+			}
+		}
+
+		if err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *ProbeMonitor) GetStatus() map[string]comunication.Device {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	devices := make(map[string]comunication.Device)
+	for id, device := range m.devices {
+		devices[id] = device
+	}
+
+	return devices
+}
+
+func (m *ProbeMonitor) GetDevices(c comunication.Complex) []comunication.Device {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	var devices []comunication.Device
+	for _, device := range m.devices {
+		if device.Key == c.Key {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices
+}
+
+func (m *ProbeMonitor) FindDevice(mac string) (comunication.Device, bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+	device, ok := m.devices[mac]
+
+	return device, ok
+}
+
+func (m *ProbeMonitor) GetStatusText(c comunication.Complex) string {
+	var msgs []string
+	for _, device := range m.GetDevices(c) {
+		msgs = append(msgs, device.GenerateStatusMessage())
+	}
+
+	return strings.Join(msgs, "\n")
+}
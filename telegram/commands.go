@@ -0,0 +1,348 @@
+package telegram
+
+import (
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go-meshtastic-monitor/comunication"
+	"go-meshtastic-monitor/core"
+	"go-meshtastic-monitor/direct_wire"
+	"go-meshtastic-monitor/probe"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultHistoryCount = 10
+const MaxHistoryCount = 50
+const DefaultUptimeDays = 7
+const MaxUptimeDays = 90
+
+type Commands struct {
+	monitor       *core.Monitor
+	onlineMonitor *direct_wire.DirectWireMonitor
+	probeMonitor  *probe.ProbeMonitor
+	history       *core.History
+	mutes         *core.Mutes
+	schedule      *core.Schedule
+}
+
+func NewCommands(monitor *core.Monitor, onlineMonitor *direct_wire.DirectWireMonitor, probeMonitor *probe.ProbeMonitor, history *core.History, mutes *core.Mutes, schedule *core.Schedule) *Commands {
+	return &Commands{
+		monitor:       monitor,
+		onlineMonitor: onlineMonitor,
+		probeMonitor:  probeMonitor,
+		history:       history,
+		mutes:         mutes,
+		schedule:      schedule,
+	}
+}
+
+func (h *Commands) List() []tgbotapi.BotCommand {
+	return []tgbotapi.BotCommand{
+		{Command: "status", Description: "Стан ліній живлення"},
+		{Command: "history", Description: "Останні зміни живлення, /history 20"},
+		{Command: "uptime", Description: "Відсоток часу зі світлом, /uptime 30"},
+		{Command: "schedule", Description: "Графік відключень"},
+		{Command: "start", Description: "Початок роботи з ботом"},
+	}
+}
+
+func (h *Commands) HandleUpdate(c comunication.Complex, bot *tgbotapi.BotAPI, u tgbotapi.Update) {
+	if u.Message == nil || !u.Message.IsCommand() {
+		return
+	}
+
+	msg := tgbotapi.NewMessage(u.Message.Chat.ID, "")
+
+	if isAdminCommand(u.Message.Command()) {
+		if u.Message.From == nil || !c.IsAdmin(u.Message.From.ID) {
+			msg.Text = "Ця команда доступна лише адміністраторам комплексу"
+		} else {
+			msg.Text = h.handleAdminCommand(c, bot, u.Message.Command(), strings.TrimSpace(u.Message.CommandArguments()))
+		}
+
+		_, _ = bot.Send(msg)
+
+		return
+	}
+
+	switch u.Message.Command() {
+	case "start":
+		msg.Text = "Вітаю!"
+		break
+	case "schedule":
+		msg.Text = h.scheduleText(c)
+		break
+	case "status":
+		msg.Text = h.statusText(c)
+		break
+	case "history":
+		msg.Text = h.historyText(c, parseArgument(u.Message.CommandArguments(), DefaultHistoryCount, MaxHistoryCount))
+		break
+	case "uptime":
+		msg.Text = h.uptimeText(c, parseArgument(u.Message.CommandArguments(), DefaultUptimeDays, MaxUptimeDays))
+		break
+	default:
+		msg.Text = "Невідома команда. Спробуйте /status"
+	}
+
+	_, _ = bot.Send(msg)
+}
+
+func (h *Commands) statusText(c comunication.Complex) string {
+	// a complex may mix timeout, direct wire, hybrid and probed lines
+	var texts []string
+	for _, text := range []string{h.monitor.GetStatusText(c), h.onlineMonitor.GetStatusText(c), h.probeMonitor.GetStatusText(c)} {
+		if text != "" {
+			texts = append(texts, text)
+		}
+	}
+
+	text := strings.Join(texts, "\n")
+	if text == "" {
+		text = "Нічого не знайдено"
+	}
+
+	return text
+}
+
+func (h *Commands) scheduleText(c comunication.Complex) string {
+	var msgs []string
+	now := time.Now()
+
+	for _, device := range h.devices(c) {
+		group, ok := c.DeviceGroupMap[device.MacAddress]
+
+		if !ok {
+			continue
+		}
+
+		if text := h.schedule.GetScheduleDescription(group, now); text != "" {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", device.Name, text))
+		}
+	}
+
+	if len(msgs) == 0 {
+		return "Графік відключень для комплексу не налаштовано"
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+func (h *Commands) historyText(c comunication.Complex, count int) string {
+	transitions, err := h.history.Last(c.Key, count)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to load history:", err.Error())
+
+		return "Не вдалося отримати історію"
+	}
+
+	if len(transitions) == 0 {
+		return "Історія порожня"
+	}
+
+	latest := make(map[string]bool)
+	var msgs []string
+
+	for _, t := range transitions {
+		isLatest := !latest[t.MacAddress]
+		latest[t.MacAddress] = true
+
+		if t.State == core.StateOn {
+			line := fmt.Sprintf("%s %s: живлення з'явилось", t.At.Format("2006-01-02 15:04"), t.DeviceName)
+
+			if d := t.OutageDuration(); d > 0 {
+				line += fmt.Sprintf(", світла не було %s", d.Round(time.Minute).String())
+			}
+
+			msgs = append(msgs, line)
+
+			continue
+		}
+
+		if t.State == core.StateUnreachable {
+			msgs = append(msgs, fmt.Sprintf("%s %s: зв'язок з пристроєм втрачено", t.At.Format("2006-01-02 15:04"), t.DeviceName))
+
+			continue
+		}
+
+		line := fmt.Sprintf("%s %s: живлення зникло", t.At.Format("2006-01-02 15:04"), t.DeviceName)
+
+		if isLatest {
+			line += fmt.Sprintf(", світла немає вже %s", time.Since(t.At).Round(time.Minute).String())
+		}
+
+		msgs = append(msgs, line)
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+func (h *Commands) uptimeText(c comunication.Complex, days int) string {
+	to := time.Now()
+	stats, err := h.history.Uptime(c.Key, to.AddDate(0, 0, -days), to)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to load history:", err.Error())
+
+		return "Не вдалося отримати історію"
+	}
+
+	if len(stats) == 0 {
+		return "Історія порожня"
+	}
+
+	msgs := []string{fmt.Sprintf("Наявність світла за %d дн.:", days)}
+
+	for _, stat := range stats {
+		total := stat.TotalSecondsOnline + stat.TotalSecondsOffline
+		percent := float64(stat.TotalSecondsOnline) * 100 / float64(total)
+		offline := time.Duration(stat.TotalSecondsOffline) * time.Second
+
+		msgs = append(msgs, fmt.Sprintf("%s: %.1f%%, без світла %s", stat.Name, percent, offline.Round(time.Minute).String()))
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+func isAdminCommand(command string) bool {
+	switch command {
+	case "mute", "unmute", "mute_all", "unmute_all", "broadcast", "devices":
+		return true
+	}
+
+	return false
+}
+
+func (h *Commands) handleAdminCommand(c comunication.Complex, bot *tgbotapi.BotAPI, command string, args string) string {
+	switch command {
+	case "mute":
+		device, until, ok := h.parseMuteArguments(c, args)
+
+		if !ok {
+			return "Лінію не знайдено. Вкажіть назву або MAC і, за бажанням, період: /mute <лінія> 2h, список: /devices"
+		}
+
+		h.mutes.MuteLine(device, until)
+
+		if until.IsZero() {
+			return fmt.Sprintf("Сповіщення для \"%s\" вимкнено", device.Name)
+		}
+
+		return fmt.Sprintf("Сповіщення для \"%s\" вимкнено до %s", device.Name, until.Format("2006-01-02 15:04"))
+	case "unmute":
+		device, ok := h.findDevice(c, args)
+
+		if !ok {
+			return "Лінію не знайдено. Вкажіть назву або MAC, список: /devices"
+		}
+
+		h.mutes.UnmuteLine(device.MacAddress)
+
+		return fmt.Sprintf("Сповіщення для \"%s\" увімкнено", device.Name)
+	case "mute_all":
+		until, err := core.ParseMuteUntil(args, time.Now())
+
+		if err != nil || until.IsZero() {
+			return "Вкажіть тривалість або час, наприклад /mute_all 2h або /mute_all 18:30"
+		}
+
+		h.mutes.MuteComplex(c, until)
+
+		return fmt.Sprintf("Сповіщення комплексу вимкнено до %s", until.Format("2006-01-02 15:04"))
+	case "unmute_all":
+		h.mutes.UnmuteComplex(c.Key)
+
+		return "Сповіщення комплексу увімкнено"
+	case "broadcast":
+		text := h.statusText(c)
+
+		for _, channel := range c.BotChannels {
+			_, err := bot.Send(tgbotapi.NewMessage(channel, text))
+
+			if err != nil {
+				log.Println("[ERROR] Failed to broadcast status:", channel, err.Error())
+			}
+		}
+
+		return fmt.Sprintf("Стан надіслано в %d канал(ів)", len(c.BotChannels))
+	case "devices":
+		devices := h.devices(c)
+
+		if len(devices) == 0 {
+			return "Нічого не знайдено"
+		}
+
+		var msgs []string
+		for _, device := range devices {
+			msgs = append(msgs, fmt.Sprintf("%s [%s] востаннє на зв'язку %s", device.Name, device.MacAddress, device.LastSeen.Format("2006-01-02 15:04:05")))
+		}
+
+		return strings.Join(msgs, "\n")
+	}
+
+	return "Невідома команда"
+}
+
+func (h *Commands) devices(c comunication.Complex) []comunication.Device {
+	devices := append(h.monitor.GetDevices(c), h.onlineMonitor.GetDevices(c)...)
+
+	return append(devices, h.probeMonitor.GetDevices(c)...)
+}
+
+// parseMuteArguments splits "<line> [period]", the period may be one or two words long ("2h", "2024-05-01 18:00").
+func (h *Commands) parseMuteArguments(c comunication.Complex, args string) (comunication.Device, time.Time, bool) {
+	if device, ok := h.findDevice(c, args); ok {
+		return device, time.Time{}, true
+	}
+
+	words := strings.Fields(args)
+
+	for size := 2; size >= 1; size-- {
+		if len(words) <= size {
+			continue
+		}
+
+		until, err := core.ParseMuteUntil(strings.Join(words[len(words)-size:], " "), time.Now())
+
+		if err != nil {
+			continue
+		}
+
+		if device, ok := h.findDevice(c, strings.Join(words[:len(words)-size], " ")); ok {
+			return device, until, true
+		}
+	}
+
+	return comunication.Device{}, time.Time{}, false
+}
+
+func (h *Commands) findDevice(c comunication.Complex, line string) (comunication.Device, bool) {
+	if line == "" {
+		return comunication.Device{}, false
+	}
+
+	for _, device := range h.devices(c) {
+		if strings.EqualFold(device.MacAddress, line) || strings.EqualFold(device.Name, line) {
+			return device, true
+		}
+	}
+
+	return comunication.Device{}, false
+}
+
+func parseArgument(argument string, def int, max int) int {
+	value, err := strconv.Atoi(strings.TrimSpace(argument))
+
+	if err != nil || value <= 0 {
+		return def
+	}
+
+	if value > max {
+		return max
+	}
+
+	return value
+}
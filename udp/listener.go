@@ -0,0 +1,362 @@
+package udp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go-meshtastic-monitor/comunication"
+	"go-meshtastic-monitor/core"
+	"go-meshtastic-monitor/ingest"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const BinaryVersion = 0x01
+const SignatureSize = 8
+const DefaultMaxSkew = 300
+const CountersKey = "udp_counters"
+const maxPacketSize = 512
+
+// distinct packets accepted with the same timestamp
+const maxSameTimestamp = 16
+
+// counters below this value are treated as a boot counter of a device without a clock
+const minUnixTimestamp = 1000000000
+
+const flagPluggedIn = 0x01
+
+type UdpDevice struct {
+	MacAddress string `json:"mac" yaml:"mac"`
+	Secret     string `json:"secret" yaml:"secret"`
+	Name       string `json:"name" yaml:"name"`
+	Kind       string `json:"kind" yaml:"kind"`
+}
+
+type UdpConf struct {
+	Bind    string      `json:"bind" yaml:"bind"`
+	MaxSkew int64       `json:"max_skew_s" yaml:"max_skew_s"`
+	Devices []UdpDevice `json:"devices" yaml:"devices"`
+}
+
+type heartbeat struct {
+	Key         string
+	MacAddress  string
+	Interval    int64
+	IsPluggedIn bool
+	Counter     uint32
+	signed      []byte
+	signature   []byte
+}
+
+// counter is the last accepted counter of a device and the signatures of the packets accepted with it
+type counter struct {
+	Value      uint32   `json:"value"`
+	Signatures []string `json:"signatures,omitempty"`
+}
+
+// Listener accepts compact signed heartbeats over UDP for devices where a TLS HTTP request is too expensive.
+//
+// Text packet: key|mac|interval|p|counter|signature, e.g. "key_complex|aa:bb|60|1|1714557600|9f86d081884c7d65"
+// Binary packet: 0x01, flags (bit 0 - plugged in), interval uint16, counter uint32, key length, key,
+// mac length, mac, signature. Integers are big endian.
+//
+// The signature is the first 8 bytes of HMAC-SHA256 with the device secret over everything before it
+// (for text packets - including the trailing "|"). The counter is a unix timestamp checked against
+// max_skew_s, or an increasing number kept across reboots for devices without a clock. Counters that
+// do not increase are rejected as replays, a timestamp may repeat only for a different packet.
+// The last counters are kept in Redis, so packets captured before a restart can not be replayed.
+type Listener struct {
+	conf    UdpConf
+	router  *ingest.Router
+	storage *core.RedisStorage
+	devices map[string]UdpDevice
+	conn    net.PacketConn
+
+	rw       sync.Mutex
+	counters map[string]counter
+}
+
+func NewListener(conf UdpConf, router *ingest.Router, storage *core.RedisStorage) *Listener {
+	if conf.MaxSkew <= 0 {
+		conf.MaxSkew = DefaultMaxSkew
+	}
+
+	l := &Listener{
+		conf:     conf,
+		router:   router,
+		storage:  storage,
+		devices:  make(map[string]UdpDevice),
+		counters: make(map[string]counter),
+	}
+
+	for _, device := range conf.Devices {
+		if device.Kind == "" {
+			device.Kind = ingest.KindTimeout
+		}
+
+		l.devices[device.MacAddress] = device
+	}
+
+	return l
+}
+
+func (l *Listener) Start() error {
+	l.restoreCounters()
+	conn, err := net.ListenPacket("udp", l.conf.Bind)
+
+	if err != nil {
+		return err
+	}
+
+	l.conn = conn
+	log.Println("[UDP] listening on", l.conf.Bind)
+
+	go func() {
+		buf := make([]byte, maxPacketSize)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+
+				log.Println("[UDP] read failed:", err.Error())
+
+				continue
+			}
+
+			if err = l.handle(buf[:n], time.Now()); err != nil {
+				log.Println("[UDP] rejected packet from", addr.String(), err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (l *Listener) Stop() {
+	if l.conn != nil {
+		_ = l.conn.Close()
+	}
+}
+
+func (l *Listener) handle(packet []byte, now time.Time) error {
+	var h heartbeat
+	var err error
+
+	if len(packet) > 0 && packet[0] == BinaryVersion {
+		h, err = parseBinary(packet)
+	} else {
+		h, err = parseText(packet)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	device, ok := l.devices[h.MacAddress]
+
+	if !ok {
+		return errors.New("unknown device " + h.MacAddress)
+	}
+
+	if !hmac.Equal(h.signature, Sign(device.Secret, h.signed)) {
+		return errors.New("bad signature from " + h.MacAddress)
+	}
+
+	if err = l.checkCounter(h, now); err != nil {
+		return err
+	}
+
+	name := device.Name
+	if name == "" {
+		name = h.MacAddress
+	}
+
+	return l.router.Route(device.Kind, comunication.Device{
+		Key:           h.Key,
+		Name:          name,
+		MacAddress:    h.MacAddress,
+		Interval:      h.Interval,
+		HasDirectWire: device.Kind != ingest.KindTimeout,
+		IsPluggedIn:   h.IsPluggedIn,
+	})
+}
+
+func (l *Listener) checkCounter(h heartbeat, now time.Time) error {
+	if h.Counter >= minUnixTimestamp {
+		skew := now.Unix() - int64(h.Counter)
+
+		if skew > l.conf.MaxSkew || -skew > l.conf.MaxSkew {
+			return errors.New("timestamp out of allowed skew from " + h.MacAddress)
+		}
+	}
+
+	l.rw.Lock()
+	defer l.rw.Unlock()
+	signature := hex.EncodeToString(h.signature)
+	last, ok := l.counters[h.MacAddress]
+	next := counter{Value: h.Counter, Signatures: []string{signature}}
+
+	if ok && h.Counter < last.Value {
+		return errors.New("replayed counter from " + h.MacAddress)
+	}
+
+	if ok && h.Counter == last.Value {
+		// a clock device may send two different packets within a second, e.g. on a power change
+		if h.Counter < minUnixTimestamp || len(last.Signatures) >= maxSameTimestamp {
+			return errors.New("replayed counter from " + h.MacAddress)
+		}
+
+		for _, s := range last.Signatures {
+			if s == signature {
+				return errors.New("replayed packet from " + h.MacAddress)
+			}
+		}
+
+		next.Signatures = append(last.Signatures, signature)
+	}
+
+	l.counters[h.MacAddress] = next
+	l.storeCounter(h.MacAddress, next)
+
+	return nil
+}
+
+func (l *Listener) restoreCounters() {
+	fields, err := l.storage.GetFields(CountersKey)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to restore udp counters:", err.Error())
+
+		return
+	}
+
+	l.rw.Lock()
+	defer l.rw.Unlock()
+
+	for mac, value := range fields {
+		var c counter
+
+		if err := json.Unmarshal([]byte(value), &c); err != nil {
+			log.Println("[ERROR] Failed to restore udp counter:", mac, err.Error())
+
+			continue
+		}
+
+		l.counters[mac] = c
+	}
+}
+
+func (l *Listener) storeCounter(mac string, c counter) {
+	b, err := json.Marshal(c)
+
+	if err != nil {
+		log.Println("[ERROR] Failed to marshal udp counter:", err.Error())
+
+		return
+	}
+
+	err = l.storage.SetFields(CountersKey, map[string]interface{}{mac: string(b)})
+
+	if err != nil {
+		log.Println("[ERROR] Failed to store udp counter:", mac, err.Error())
+	}
+}
+
+func Sign(secret string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+
+	return mac.Sum(nil)[:SignatureSize]
+}
+
+func parseText(packet []byte) (heartbeat, error) {
+	text := strings.TrimSpace(string(packet))
+	i := strings.LastIndex(text, "|")
+
+	if i < 0 {
+		return heartbeat{}, errors.New("malformed text packet")
+	}
+
+	parts := strings.Split(text[:i], "|")
+
+	if len(parts) != 5 {
+		return heartbeat{}, errors.New("malformed text packet")
+	}
+
+	interval, err := strconv.ParseInt(parts[2], 10, 64)
+
+	if err != nil {
+		return heartbeat{}, errors.New("bad interval")
+	}
+
+	counter, err := strconv.ParseUint(parts[4], 10, 32)
+
+	if err != nil {
+		return heartbeat{}, errors.New("bad counter")
+	}
+
+	signature, err := hex.DecodeString(text[i+1:])
+
+	if err != nil {
+		return heartbeat{}, errors.New("bad signature encoding")
+	}
+
+	return heartbeat{
+		Key:         parts[0],
+		MacAddress:  parts[1],
+		Interval:    interval,
+		IsPluggedIn: parts[3] == "1",
+		Counter:     uint32(counter),
+		signed:      []byte(text[:i+1]),
+		signature:   signature,
+	}, nil
+}
+
+func parseBinary(packet []byte) (heartbeat, error) {
+	malformed := errors.New("malformed binary packet")
+
+	if len(packet) < 9+SignatureSize {
+		return heartbeat{}, malformed
+	}
+
+	body := packet[:len(packet)-SignatureSize]
+	h := heartbeat{
+		IsPluggedIn: body[1]&flagPluggedIn != 0,
+		Interval:    int64(binary.BigEndian.Uint16(body[2:4])),
+		Counter:     binary.BigEndian.Uint32(body[4:8]),
+		signed:      body,
+		signature:   packet[len(packet)-SignatureSize:],
+	}
+
+	rest := body[8:]
+	var fields []string
+
+	for i := 0; i < 2; i++ {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return heartbeat{}, malformed
+		}
+
+		fields = append(fields, string(rest[1:1+int(rest[0])]))
+		rest = rest[1+int(rest[0]):]
+	}
+
+	if len(rest) != 0 {
+		return heartbeat{}, malformed
+	}
+
+	h.Key = fields[0]
+	h.MacAddress = fields[1]
+
+	return h, nil
+}
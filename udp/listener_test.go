@@ -0,0 +1,251 @@
+package udp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"go-meshtastic-monitor/comunication"
+	"go-meshtastic-monitor/core"
+	"go-meshtastic-monitor/direct_wire"
+	"go-meshtastic-monitor/ingest"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "secret"
+const testMac = "aa:bb"
+
+var testNow = time.Unix(1714557600, 0)
+
+// fakeRedis keeps hashes in memory and answers the commands the listener uses: PING, HMSET and HGETALL.
+type fakeRedis struct {
+	listener net.Listener
+
+	rw     sync.Mutex
+	hashes map[string]map[string]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeRedis{listener: listener, hashes: make(map[string]map[string]string)}
+	go r.serve()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	return r
+}
+
+func (r *fakeRedis) storage() *core.RedisStorage {
+	host, port, _ := net.SplitHostPort(r.listener.Addr().String())
+
+	return core.NewRedisStorage(core.NewRedisConnect(core.RedisConf{Host: host, Port: port}))
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for {
+		args, err := readCommand(reader)
+
+		if err != nil {
+			return
+		}
+
+		r.rw.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			fmt.Fprint(conn, "+PONG\r\n")
+		case "HMSET":
+			hash, ok := r.hashes[args[1]]
+			if !ok {
+				hash = make(map[string]string)
+				r.hashes[args[1]] = hash
+			}
+
+			for i := 2; i+1 < len(args); i += 2 {
+				hash[args[i]] = args[i+1]
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		case "HGETALL":
+			hash := r.hashes[args[1]]
+			fmt.Fprintf(conn, "*%d\r\n", len(hash)*2)
+			for field, value := range hash {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(field), field, len(value), value)
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command %s\r\n", args[0])
+		}
+		r.rw.Unlock()
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		if _, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+
+		arg, err := reader.ReadString('\n')
+
+		if err != nil {
+			return nil, err
+		}
+
+		args[i] = strings.TrimRight(arg, "\r\n")
+	}
+
+	return args, nil
+}
+
+func newTestListener(storage *core.RedisStorage) *Listener {
+	notifier := core.NewNotifier("", core.OperatorConf{}, nil)
+	complexes := []comunication.Complex{{Key: "k", Name: "Дім"}}
+	router := ingest.NewRouter(nil, direct_wire.NewDirectWireMonitor(notifier, complexes, nil))
+
+	return NewListener(UdpConf{
+		Devices: []UdpDevice{{MacAddress: testMac, Secret: testSecret, Name: "Квартира", Kind: ingest.KindDirect}},
+	}, router, storage)
+}
+
+func textPacket(secret string, interval int64, pluggedIn bool, counter uint32) []byte {
+	p := "0"
+	if pluggedIn {
+		p = "1"
+	}
+
+	signed := fmt.Sprintf("k|%s|%d|%s|%d|", testMac, interval, p, counter)
+
+	return []byte(signed + hex.EncodeToString(Sign(secret, []byte(signed))))
+}
+
+func binaryPacket(secret string, interval uint16, pluggedIn bool, counter uint32) []byte {
+	body := []byte{BinaryVersion, 0}
+	if pluggedIn {
+		body[1] = flagPluggedIn
+	}
+
+	body = binary.BigEndian.AppendUint16(body, interval)
+	body = binary.BigEndian.AppendUint32(body, counter)
+	body = append(body, 1, 'k', byte(len(testMac)))
+	body = append(body, testMac...)
+
+	return append(body, Sign(secret, body)...)
+}
+
+func TestListenerHandle(t *testing.T) {
+	now := uint32(testNow.Unix())
+
+	sameTimestamp := func(n int) [][]byte {
+		var packets [][]byte
+		for i := 0; i < n; i++ {
+			packets = append(packets, textPacket(testSecret, int64(60+i), true, now))
+		}
+
+		return packets
+	}
+
+	// a correctly signed packet whose mac length claims more bytes than the packet has
+	truncated := binaryPacket(testSecret, 60, true, now)
+	body := truncated[:len(truncated)-SignatureSize]
+	body[10] = 200
+	copy(truncated[len(body):], Sign(testSecret, body))
+
+	tests := []struct {
+		name    string
+		packets [][]byte
+		// accepted is the number of leading packets accepted, the rest are rejected
+		accepted int
+	}{
+		{"valid text", [][]byte{textPacket(testSecret, 60, true, now)}, 1},
+		{"valid binary", [][]byte{binaryPacket(testSecret, 60, false, now)}, 1},
+		{"bad signature", [][]byte{textPacket("other", 60, true, now)}, 0},
+		{"same counter and signature", [][]byte{textPacket(testSecret, 60, true, now), textPacket(testSecret, 60, true, now)}, 1},
+		{"same timestamp with another signature", sameTimestamp(maxSameTimestamp + 1), maxSameTimestamp},
+		{"older timestamp", [][]byte{textPacket(testSecret, 60, true, now), textPacket(testSecret, 60, false, now-1)}, 1},
+		{"boot counter does not increase", [][]byte{textPacket(testSecret, 60, true, 5), textPacket(testSecret, 60, false, 5), textPacket(testSecret, 60, false, 4)}, 1},
+		{"boot counter increases", [][]byte{textPacket(testSecret, 60, true, 5), textPacket(testSecret, 60, false, 6)}, 2},
+		{"timestamp beyond skew in the past", [][]byte{textPacket(testSecret, 60, true, now-DefaultMaxSkew-1)}, 0},
+		{"timestamp beyond skew in the future", [][]byte{textPacket(testSecret, 60, true, now+DefaultMaxSkew+1)}, 0},
+		{"truncated binary length prefix", [][]byte{truncated}, 0},
+		{"malformed text", [][]byte{[]byte("k|aa:bb|60|1")}, 0},
+	}
+
+	redis := newFakeRedis(t)
+	storage := redis.storage()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redis.rw.Lock()
+			redis.hashes = make(map[string]map[string]string)
+			redis.rw.Unlock()
+			l := newTestListener(storage)
+
+			for i, packet := range tt.packets {
+				err := l.handle(packet, testNow)
+
+				if i < tt.accepted && err != nil {
+					t.Fatalf("packet %d rejected: %s", i, err)
+				}
+
+				if i >= tt.accepted && err == nil {
+					t.Fatalf("packet %d accepted", i)
+				}
+			}
+		})
+	}
+}
+
+func TestListenerRestoresCounters(t *testing.T) {
+	redis := newFakeRedis(t)
+	storage := redis.storage()
+	packet := textPacket(testSecret, 60, true, uint32(testNow.Unix()))
+
+	l := newTestListener(storage)
+	if err := l.handle(packet, testNow); err != nil {
+		t.Fatal(err)
+	}
+
+	// a packet captured before the restart is still a replay
+	l = newTestListener(storage)
+	l.restoreCounters()
+	if err := l.handle(packet, testNow); err == nil {
+		t.Fatal("replayed packet accepted after restart")
+	}
+}